@@ -2,112 +2,273 @@ package main
 
 import (
 	"bittorrent/torrent"
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
 func main() {
-	// Create TorrentFile with the path to your test torrent
-	tf := torrent.TorrentFile{
-		Path: "torrent/test.torrent",
+	// verify <torrent> <dir> checks existing data and exits
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		runVerify(os.Args[2:])
+		return
 	}
 
-	// Parse the torrent file and get all info
-	tfi, err := tf.SetTorrentFileInfo()
+	pickerName := flag.String("picker", "rarest", "piece picking strategy: rarest, sequential, priority or streaming")
+	filePriorities := flag.String("files", "", "per file priorities as index=priority pairs, e.g. 0=skip,2=high (skip, low, normal, high)")
+	savePath := flag.String("dir", "./asdf/", "directory to save downloaded files in")
+	storageType := flag.String("storage", "file", "where data is stored: file, mmap or memory")
+	incompleteDir := flag.String("incomplete-dir", "", "keep files here until they're complete, then move them to -dir")
+	partSuffix := flag.Bool("part-suffix", false, "add .part to file names until they're complete")
+	httpAddr := flag.String("http", "", "serve the torrent's files over HTTP on this address while downloading, e.g. :8080")
+	allocationName := flag.String("allocate", "sparse", "how files get their space: sparse, full (preallocated) or none (grow as written)")
+	cacheMB := flag.Int64("cache-mb", 64, "memory budget in MB for assembling pieces before writing them, 0 writes blocks directly")
+	seed := flag.Bool("seed", false, "keep running once the download is complete instead of exiting")
+	recheck := flag.Bool("recheck", false, "hash existing data before downloading instead of trusting resume data")
+	listenAddr := flag.String("listen", ":6881", "address peers connect to us on, empty to not accept connections")
+	downloadLimit := flag.Int64("download-limit", 0, "download limit across all torrents in KiB/s, 0 for none")
+	logLevel := flag.String("log-level", "warn", "log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "log format: text or json")
+	flag.Parse()
+
+	logger, err := newLogger(*logLevel, *logFormat)
 	if err != nil {
-		log.Fatalf("Error parsing torrent file: %v", err)
+		log.Fatalf("Invalid logging flags: %v", err)
 	}
 
-	fmt.Println("=== Torrent File Information ===")
-	fmt.Printf("InfoHash: %s\n", tfi.InfoHash)
-	fmt.Printf("Mode: %s\n", tfi.Mode)
-	fmt.Printf("File Length: %d bytes (%.2f MB)\n", tfi.FileLength, float64(tfi.FileLength)/(1024*1024))
-	fmt.Printf("Piece Length: %d bytes\n", tfi.PieceLength)
-	fmt.Printf("Total Pieces: %d\n", tfi.TotalPieces)
-
-	fmt.Println("\n=== Trackers ===")
-	for i, tracker := range tfi.Trackers {
-		fmt.Printf("%d. [%s] %s\n", i+1, tracker.Kind, tracker.Url)
+	priorities, err := parseFilePriorities(*filePriorities)
+	if err != nil {
+		log.Fatalf("Invalid -files: %v", err)
 	}
 
-	fmt.Println("\n=== Info Dictionary Keys ===")
-	for key := range tfi.Info {
-		fmt.Printf("- %s\n", key)
+	allocation, err := torrent.ParseAllocation(*allocationName)
+	if err != nil {
+		log.Fatalf("Invalid -allocate: %v", err)
 	}
 
-	fmt.Println("\n Torrent file parsed successfully!\n")
+	_, err = torrent.NewPiecePicker(*pickerName)
+	if err != nil {
+		log.Fatalf("Invalid -picker: %v", err)
+	}
 
-	idlePeerBus := &torrent.IdlePeerBus{
-		Peer: make(chan *torrent.Peer),
+	torrentPaths := flag.Args()
+	if len(torrentPaths) == 0 {
+		torrentPaths = []string{"torrent/test.torrent"}
 	}
 
-	blockRequestBus := &torrent.BlockRequestBus{
-		BlockRequest: make(chan *torrent.BlockRequest),
+	// Ctrl+C stops every torrent cleanly so the next run carries on from here
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// 0 means no cache for -cache-mb, it's the default size for Config
+	cacheSize := *cacheMB * 1024 * 1024
+	if cacheSize == 0 {
+		cacheSize = -1
 	}
+	client, err := torrent.NewClient(torrent.Config{
+		ListenAddr:    *listenAddr,
+		DownloadLimit: *downloadLimit * 1024,
+		CacheSize:     cacheSize,
+		DataDir:       *savePath,
+		Logger:        logger,
+	})
+	if err != nil {
+		log.Fatalf("Failed to start client: %v", err)
+	}
+
+	// Progress comes from events, logs are for when something's off
+	events := client.Subscribe(0)
+	go printEvents(events)
+
+	fmt.Println("\n Starting download...")
+	var torrents []*torrent.Torrent
+	for _, path := range torrentPaths {
+		// Pickers keep state per torrent
+		piecePicker, _ := torrent.NewPiecePicker(*pickerName)
+		config := torrent.TorrentConfig{
+			FilePriorities: priorities,
+			PiecePicker:    piecePicker,
+			StorageType:    torrent.StorageType(*storageType),
+			Allocation:     allocation,
+			IncompleteDir:  *incompleteDir,
+			PartSuffix:     *partSuffix,
+			Seed:           *seed,
+			Recheck:        *recheck,
+		}
 
-	blockRequestResponseBus := &torrent.BlockRequestResponseBus{
-		BlockResponse: make(chan *torrent.BlockResponse),
+		var t *torrent.Torrent
+		if strings.HasPrefix(path, "magnet:") {
+			t, err = client.AddMagnet(ctx, path, config)
+		} else {
+			t, err = client.AddTorrentFile(path, config)
+		}
+		if err != nil {
+			client.Close()
+			log.Fatalf("Failed to add %s: %v", path, err)
+		}
+		printTorrentInfo(t)
+		torrents = append(torrents, t)
 	}
 
-	blockWrittenBus := &torrent.BlockWrittenBus{
-		BlockWritten: make(chan *torrent.BlockWritten),
+	if *httpAddr != "" {
+		server := &torrent.StreamServer{Torrent: torrents[0], Logger: logger}
+		fmt.Printf(" Streaming files on http://%s/\n", *httpAddr)
+		go func() {
+			err := http.ListenAndServe(*httpAddr, server)
+			if err != nil {
+				log.Fatalf("HTTP server failed: %v", err)
+			}
+		}()
 	}
 
-	peerManager := &torrent.PeerManager{
-		Infohash:                tfi.InfoHash,
-		IdlePeerBus:             idlePeerBus,
-		BlockRequestBus:         blockRequestBus,
-		BlockRequestResponseBus: blockRequestResponseBus,
+	completed := true
+	for _, t := range torrents {
+		err := t.Wait(ctx)
+		if err != nil {
+			completed = false
+			break
+		}
+	}
+	if completed && *seed {
+		<-ctx.Done()
 	}
 
-	trackerManager := &torrent.TrackerManager{
-		Infohash:    tfi.InfoHash,
-		Pm:          peerManager,
-		Trackers:    tfi.Trackers,
-		TotalPieces: uint(tfi.TotalPieces),
+	fmt.Println("\n Stopping...")
+	err = client.Close()
+	if err != nil {
+		log.Fatalf("Failed to stop: %v", err)
+	}
+	if completed {
+		fmt.Printf(" All done, files are in %s\n", *savePath)
 	}
+}
 
-	fmt.Println("\n Starting download...")
+// printTorrentInfo prints what's in the torrent
+func printTorrentInfo(t *torrent.Torrent) {
+	stats := t.Stats()
 
-	// Start tracker communication in background
-	go trackerManager.AskForPeers()
+	fmt.Println("=== Torrent Information ===")
+	fmt.Printf("InfoHash: %s\n", t.InfoHash())
+	fmt.Printf("Name: %s\n", t.Name())
+	fmt.Printf("Length: %d bytes (%.2f MB)\n", stats.Length, float64(stats.Length)/(1024*1024))
+	fmt.Printf("Total Pieces: %d\n", stats.PiecesTotal)
+	fmt.Printf("Pieces Done: %d/%d wanted\n", stats.PiecesDone, stats.PiecesWanted)
 
-	pieceManager := &torrent.PieceManager{
-		PieceLength: uint(tfi.PieceLength),
-		FileLength:  uint(tfi.FileLength),
-		TotalPieces: uint(tfi.TotalPieces),
+	fmt.Println("\n=== Files ===")
+	for _, file := range t.Files() {
+		fmt.Printf("%d. %s (%d bytes)\n", file.Index, file.Path, file.Length)
 	}
+	fmt.Println()
+}
 
-	err = pieceManager.InitPieces()
+// newLogger makes the logger everything logs to, on stderr
+func newLogger(level, format string) (*slog.Logger, error) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
 	if err != nil {
-		log.Fatalf("Failed to initialize pieces: %v", err)
+		return nil, err
 	}
 
-	diskManager := &torrent.DiskManager{
-		TorrentFileInfo: &tfi,
-		BlockWrittenBus: blockWrittenBus,
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, options)), nil
 	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+// printEvents prints progress, every whole percent, and what went wrong
+// until the subscription is closed
+func printEvents(subscription *torrent.Subscription) {
+	percents := make(map[string]int)
+	for event := range subscription.Events() {
+		switch event := event.(type) {
+		case torrent.PieceCompleted:
+			percent := event.Done * 100 / max(event.Wanted, 1)
+			if percent != percents[event.InfoHash] {
+				percents[event.InfoHash] = percent
+				fmt.Printf(" %s: %d/%d pieces (%d%%)\n", event.InfoHash[:8], event.Done, event.Wanted, percent)
+			}
+		case torrent.PieceHashFailed:
+			fmt.Printf(" %s: piece %d failed verification, downloading it again\n", event.InfoHash[:8], event.Piece)
+		case torrent.StorageError:
+			fmt.Printf("❌ %s: storage error: %v\n", event.InfoHash[:8], event.Err)
+		case torrent.TorrentCompleted:
+			fmt.Printf(" %s: DOWNLOAD COMPLETE!\n", event.InfoHash[:8])
+		}
+	}
+}
 
-	// Scaffold files on disk before downloading
-	diskManager.ScaffoldFiles()
+// parseFilePriorities parses "0=skip,2=high" into file index -> priority
+func parseFilePriorities(value string) (map[int]torrent.Priority, error) {
+	priorities := make(map[int]torrent.Priority)
+	if value == "" {
+		return priorities, nil
+	}
 
-	torrentManager := &torrent.TorrentManager{
-		TorrentFilePath:         "torrent/test.torrent",
-		PeerManager:             peerManager,
-		PieceManager:            pieceManager,
-		BlockRequestBus:         blockRequestBus,
-		BlockRequestResponseBus: blockRequestResponseBus,
-		BlockWrittenBus:         blockWrittenBus,
-		DiskManager:             diskManager,
+	for _, pair := range strings.Split(value, ",") {
+		indexStr, priorityStr, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected index=priority, got %q", pair)
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(indexStr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid file index %q", indexStr)
+		}
+		priority, err := torrent.ParsePriority(strings.TrimSpace(priorityStr))
+		if err != nil {
+			return nil, err
+		}
+		priorities[index] = priority
 	}
+	return priorities, nil
+}
 
-	// Start background workers
-	go peerManager.FindIdlePeers()
-	go peerManager.ReadBlockRequestBus()
+// runVerify checks the data in a directory against a torrent, prints what's
+// missing or corrupt per file and exits non-zero if anything is
+func runVerify(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: bittorrent verify <torrent> <dir>")
+		os.Exit(2)
+	}
 
-	// Start the download
-	_, err = torrentManager.Download()
+	tf := torrent.TorrentFile{
+		Path: args[0],
+	}
+	tfi, err := tf.SetTorrentFileInfo()
+	if err != nil {
+		log.Fatalf("Error parsing torrent file: %v", err)
+	}
+
+	result, err := torrent.VerifyData(&tfi, args[1], 0)
 	if err != nil {
-		log.Fatalf("Download failed: %v", err)
+		log.Fatalf("Verify failed: %v", err)
+	}
+
+	fmt.Println("=== Files ===")
+	for _, file := range result.Files {
+		status := "ok"
+		if file.Missing > 0 || file.Corrupt > 0 {
+			status = fmt.Sprintf("%d missing, %d corrupt", file.Missing, file.Corrupt)
+		}
+		fmt.Printf("%s (%d pieces): %s\n", file.Path, file.Pieces, status)
+	}
+
+	fmt.Printf("\n%d/%d pieces verified, %d missing, %d corrupt\n",
+		len(result.Verified), tfi.TotalPieces, len(result.Missing), len(result.Corrupt))
+	if len(result.Missing) > 0 || len(result.Corrupt) > 0 {
+		fmt.Printf("Missing pieces: %v\n", result.Missing)
+		fmt.Printf("Corrupt pieces: %v\n", result.Corrupt)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,111 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Allocation is how files get their space on disk when scaffolding
+type Allocation string
+
+const (
+	// Truncate to the final size, blocks get allocated as they're written.
+	// Instant, but fragments badly on some filesystems.
+	AllocateSparse Allocation = "sparse"
+	// Reserve every byte up front (fallocate, or writing zeros where that
+	// isn't supported). Slow to start, but files end up contiguous.
+	AllocateFull Allocation = "full"
+	// Start empty and let writes grow the file
+	AllocateNone Allocation = "none"
+)
+
+// Returned by fallocate on platforms/filesystems that can't do it
+var errFallocateUnsupported = errors.New("fallocate not supported")
+
+// Returned by freeSpace when the platform can't tell
+var errFreeSpaceUnknown = errors.New("free space unknown")
+
+// Size of the zero buffer when preallocating by hand
+const zeroChunkSize = 1 << 20
+
+// ParseAllocation maps sparse, full and none to an Allocation
+func ParseAllocation(name string) (Allocation, error) {
+	switch Allocation(name) {
+	case AllocateSparse, AllocateFull, AllocateNone:
+		return Allocation(name), nil
+	}
+	return AllocateSparse, fmt.Errorf("unknown allocation %q (sparse, full or none)", name)
+}
+
+// allocateFile gives an open file the space the allocation asks for.
+// Existing data below currentSize is never touched.
+func allocateFile(file *os.File, currentSize, fileSize int64, allocation Allocation) error {
+	if currentSize > fileSize {
+		err := file.Truncate(fileSize)
+		if err != nil {
+			return err
+		}
+		currentSize = fileSize
+	}
+
+	switch allocation {
+	case AllocateNone:
+		return nil
+	case AllocateFull:
+		err := fallocate(file, fileSize)
+		if errors.Is(err, errFallocateUnsupported) {
+			return writeZeros(file, currentSize, fileSize)
+		}
+		return err
+	}
+	return file.Truncate(fileSize)
+}
+
+// writeZeros fills [from, to) with zeros so the filesystem has to allocate
+// real blocks for it
+func writeZeros(file *os.File, from, to int64) error {
+	zeros := make([]byte, min(zeroChunkSize, max(to-from, 0)))
+	for offset := from; offset < to; {
+		n, err := file.WriteAt(zeros[:min(int64(len(zeros)), to-offset)], offset)
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+	return nil
+}
+
+// checkFreeSpace refuses to start when the volume files are written to
+// can't hold what's left to write of the wanted files. Existing files count
+// with the blocks they really use, not their size, so sparse files from an
+// earlier run aren't taken as written. Skipped files and the part file
+// aren't counted. Platforms that can't report free space always pass.
+func (diskManager *DiskManager) checkFreeSpace() error {
+	needed := int64(0)
+	for _, fileData := range diskManager.filesMap.filesData {
+		if fileData.priority == PrioritySkip {
+			continue
+		}
+		size := int64(0)
+		info, err := os.Stat(fileData.filePath)
+		if err == nil {
+			size = min(allocatedSize(info), fileData.fileSize)
+		}
+		needed += fileData.fileSize - size
+	}
+
+	// Data is written to the incomplete directory when there is one
+	dir := diskManager.incompleteDir()
+	free, err := freeSpace(dir)
+	if errors.Is(err, errFreeSpaceUnknown) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("checking free space in %s: %w", dir, err)
+	}
+	if free < needed {
+		return fmt.Errorf("not enough space in %s: need %d bytes, %d free", dir, needed, free)
+	}
+	return nil
+}
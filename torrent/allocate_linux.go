@@ -0,0 +1,19 @@
+package torrent
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate reserves the file's blocks up to size without writing them.
+// Some filesystems (tmpfs on old kernels, FAT, network mounts) can't.
+func fallocate(file *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return errFallocateUnsupported
+	}
+	return err
+}
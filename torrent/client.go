@@ -0,0 +1,476 @@
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Start of our peer ID, the rest is random
+const peerIDPrefix = "-GB0001-"
+
+// How long a peer gets to send its handshake, when connecting to us or
+// answering ours
+const handshakeTimeout = 10 * time.Second
+
+var ErrClientClosed = errors.New("client closed")
+
+// Config is what a Client is created with. The zero value works: a random
+// peer ID, nobody connecting to us, no download limit and default budgets.
+type Config struct {
+	// Address peers connect to, e.g. ":6881". Nobody can connect to us when
+	// empty.
+	ListenAddr string
+	// Sent to trackers and peers (20 bytes), a random one is made up when
+	// empty
+	PeerID string
+	// Bytes per second downloaded from all peers of all torrents, no limit
+	// when zero
+	DownloadLimit int64
+	// Storage writes running at once across torrents, defaultWriteWorkers
+	// when zero
+	DiskWorkers int
+	// Bytes of memory shared by every torrent for assembling pieces before
+	// they're written. 64 MiB when zero, negative writes blocks directly.
+	CacheSize int64
+	// Where torrents are saved unless their TorrentConfig says otherwise,
+	// ./asdf/ when empty
+	DataDir string
+	// Where everything is logged, with attributes saying which torrent,
+	// component, peer or piece a line is about. Nothing is logged when nil.
+	Logger *slog.Logger
+}
+
+// Client runs any number of torrents side by side. It owns what they share:
+// the port peers connect to, our peer ID, the download limit, the disk
+// write slots and the piece buffer budget. Peers connecting to us are
+// handed to the torrent their handshake asks for.
+//
+// Its methods are safe for concurrent use.
+type Client struct {
+	config          Config
+	logger          *slog.Logger
+	listener        net.Listener
+	downloadLimiter *RateLimiter
+	diskWorkers     *DiskWorkers
+	writeCache      *WriteCache
+	events          *eventBus
+	torrents        map[string]*Torrent // by info hash
+	ctx             context.Context
+	cancel          context.CancelFunc
+	// info hashes addTorrent is setting up, a second Add of one of them
+	// fails right away instead of scaffolding the same files and saving
+	// over the first one's resume data
+	adding map[string]bool
+	// accept loop and handshakes in progress
+	conns  sync.WaitGroup
+	closed bool
+	mu     sync.Mutex
+}
+
+// TorrentConfig is how one torrent is downloaded. The zero value downloads
+// everything into the client's DataDir.
+type TorrentConfig struct {
+	// Directory the torrent is saved in, the client's DataDir when empty
+	SavePath string
+	// File index -> priority, files not in here are normal
+	FilePriorities map[int]Priority
+	// Rarest first when nil. Pickers can't be shared between torrents.
+	PiecePicker PiecePicker
+	// file (default), mmap or memory
+	StorageType StorageType
+	// sparse (default), full or none
+	Allocation Allocation
+	// See DiskManager
+	IncompleteDir string
+	PartSuffix    bool
+	// Keep the torrent running once complete instead of stopping it
+	Seed bool
+	// Hash existing data before downloading instead of trusting resume data
+	Recheck bool
+}
+
+// NewClient creates a client and starts listening for peers when
+// config.ListenAddr is set. Close it once done.
+func NewClient(config Config) (*Client, error) {
+	if config.PeerID == "" {
+		config.PeerID = newPeerID()
+	}
+	if len(config.PeerID) != 20 {
+		return nil, fmt.Errorf("peer ID has to be 20 bytes, got %d", len(config.PeerID))
+	}
+
+	c := &Client{
+		config:          config,
+		logger:          loggerOr(config.Logger),
+		downloadLimiter: NewRateLimiter(config.DownloadLimit),
+		diskWorkers:     NewDiskWorkers(config.DiskWorkers),
+		writeCache:      NewWriteCache(max(config.CacheSize, 0)),
+		events:          newEventBus(),
+		torrents:        make(map[string]*Torrent),
+		adding:          make(map[string]bool),
+	}
+	if config.CacheSize == 0 {
+		c.writeCache.Budget = defaultCacheBudget
+	}
+
+	if config.ListenAddr != "" {
+		listener, err := net.Listen("tcp", config.ListenAddr)
+		if err != nil {
+			return nil, fmt.Errorf("listening on %s: %w", config.ListenAddr, err)
+		}
+		c.listener = listener
+		c.logger.Info("listening for peers", "addr", listener.Addr().String())
+	}
+
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if c.listener != nil {
+		c.conns.Add(1)
+		go func() {
+			defer c.conns.Done()
+			c.acceptPeers()
+		}()
+	}
+	return c, nil
+}
+
+// PeerID is the ID we go by, the configured one or the random one made up
+// for us
+func (c *Client) PeerID() string {
+	return c.config.PeerID
+}
+
+// Addr is the address peers can connect to, nil when not listening
+func (c *Client) Addr() net.Addr {
+	if c.listener == nil {
+		return nil
+	}
+	return c.listener.Addr()
+}
+
+// port is what trackers are told peers can connect to
+func (c *Client) port() uint16 {
+	if c.listener == nil {
+		return 0
+	}
+	return uint16(c.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func newPeerID() string {
+	random := make([]byte, 6)
+	rand.Read(random)
+	return peerIDPrefix + hex.EncodeToString(random)
+}
+
+// acceptPeers takes connections until the listener is closed
+func (c *Client) acceptPeers() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+		c.conns.Add(1)
+		go func() {
+			defer c.conns.Done()
+			c.routePeer(conn)
+		}()
+	}
+}
+
+// routePeer reads the handshake of a peer that connected to us and hands
+// it to the torrent it's for. Unknown torrents get the connection closed.
+func (c *Client) routePeer(conn net.Conn) {
+	// Don't keep Close waiting on a slow handshake
+	stop := context.AfterFunc(c.ctx, func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	handshake := make([]byte, 68)
+	_, err := io.ReadFull(conn, handshake)
+	if !stop() {
+		return
+	}
+	if err != nil || handshake[0] != 19 || string(handshake[1:20]) != "BitTorrent protocol" {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	infoHash := hex.EncodeToString(handshake[28:48])
+	t := c.Torrent(infoHash)
+	if t == nil {
+		c.logger.Debug("peer asked for a torrent we don't have",
+			"peer", conn.RemoteAddr().String(), "infohash", infoHash)
+		conn.Close()
+		return
+	}
+	t.acceptPeer(conn, string(handshake[48:68]))
+}
+
+// AddTorrentFile adds the torrent file at path and starts downloading it.
+// Resume data under the save path is picked up and files are laid out
+// before this returns.
+func (c *Client) AddTorrentFile(path string, config TorrentConfig) (*Torrent, error) {
+	tf := TorrentFile{Path: path}
+	tfi, err := tf.SetTorrentFileInfo()
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return c.addTorrent(path, &tfi, config)
+}
+
+// AddTorrentBytes is AddTorrentFile for a torrent file that's in memory
+func (c *Client) AddTorrentBytes(data []byte, config TorrentConfig) (*Torrent, error) {
+	tf := TorrentFile{Data: data}
+	tfi, err := tf.SetTorrentFileInfo()
+	if err != nil {
+		return nil, fmt.Errorf("parsing torrent: %w", err)
+	}
+	return c.addTorrent("", &tfi, config)
+}
+
+// addTorrent sets up a parsed torrent and starts it, unless one with the
+// same info hash was added (or is being added) already
+func (c *Client) addTorrent(path string, tfi *TorrentFileInfo, config TorrentConfig) (*Torrent, error) {
+	c.mu.Lock()
+	closed := c.closed
+	_, exists := c.torrents[tfi.InfoHash]
+	exists = exists || c.adding[tfi.InfoHash]
+	if !closed && !exists {
+		c.adding[tfi.InfoHash] = true
+	}
+	c.mu.Unlock()
+	if closed {
+		return nil, ErrClientClosed
+	}
+	if exists {
+		return nil, fmt.Errorf("torrent %s already added", tfi.InfoHash)
+	}
+	defer func() {
+		c.mu.Lock()
+		delete(c.adding, tfi.InfoHash)
+		c.mu.Unlock()
+	}()
+
+	t, err := c.newTorrent(path, tfi, config)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	// The info hash is ours, only closing the client can get in the way
+	closed = c.closed
+	if !closed {
+		err = t.Start(c.ctx)
+		if err == nil {
+			c.torrents[tfi.InfoHash] = t
+		}
+	}
+	c.mu.Unlock()
+
+	if err == nil && !closed {
+		return t, nil
+	}
+	if err == nil {
+		err = ErrClientClosed
+	}
+	t.Stop()
+	return nil, err
+}
+
+// newTorrent wires up the components of one torrent and lays out its files
+func (c *Client) newTorrent(path string, tfi *TorrentFileInfo, config TorrentConfig) (*Torrent, error) {
+	savePath := config.SavePath
+	if savePath == "" {
+		savePath = c.config.DataDir
+	}
+	logger := c.logger.With("infohash", tfi.InfoHash)
+
+	idlePeers := newIdlePeerBus()
+	requests := &blockRequestBus{
+		requests: make(chan *blockRequest),
+	}
+	responses := &blockRequestResponseBus{
+		responses: make(chan *blockResponse),
+	}
+	written := &blockWrittenBus{
+		written: make(chan *blockWritten),
+	}
+	dropped := &droppedRequestBus{
+		peers: make(chan *Peer),
+	}
+
+	pieceManager := &PieceManager{
+		PieceLength: uint(tfi.PieceLength),
+		FileLength:  uint(tfi.FileLength),
+		TotalPieces: uint(tfi.TotalPieces),
+	}
+	err := pieceManager.InitPieces()
+	if err != nil {
+		return nil, fmt.Errorf("initializing pieces: %w", err)
+	}
+
+	peerManager := &PeerManager{
+		Infohash:                tfi.InfoHash,
+		idlePeerBus:             idlePeers,
+		blockRequestBus:         requests,
+		blockRequestResponseBus: responses,
+		droppedRequestBus:       dropped,
+		Availability:            pieceManager.Availability,
+		DownloadLimiter:         c.downloadLimiter,
+		Logger:                  logger.With("component", "peers"),
+	}
+
+	trackerManager := &TrackerManager{
+		Infohash:    tfi.InfoHash,
+		Pm:          peerManager,
+		Trackers:    tfi.Trackers,
+		TotalPieces: uint(tfi.TotalPieces),
+		PeerID:      c.config.PeerID,
+		Port:        c.port(),
+		Logger:      logger.With("component", "tracker"),
+		events:      c.events,
+	}
+
+	diskManager := &DiskManager{
+		TorrentFileInfo: tfi,
+		SavePath:        savePath,
+		FilePriorities:  config.FilePriorities,
+		StorageType:     config.StorageType,
+		Allocation:      config.Allocation,
+		IncompleteDir:   config.IncompleteDir,
+		PartSuffix:      config.PartSuffix,
+		WriteCache:      c.writeCache,
+		DiskWorkers:     c.diskWorkers,
+		Logger:          logger.With("component", "disk"),
+		blockWrittenBus: written,
+	}
+
+	torrentManager := &TorrentManager{
+		TorrentFilePath:         path,
+		PeerManager:             peerManager,
+		PieceManager:            pieceManager,
+		blockRequestBus:         requests,
+		blockRequestResponseBus: responses,
+		blockWrittenBus:         written,
+		DiskManager:             diskManager,
+		PiecePicker:             config.PiecePicker,
+		TrackerManager:          trackerManager,
+		Seed:                    config.Seed,
+		Logger:                  logger.With("component", "torrent"),
+		events:                  c.events,
+	}
+
+	// Pick up progress from a previous run, this decides which files get
+	// created so it has to happen before scaffolding
+	err = torrentManager.LoadResumeData()
+	if err != nil {
+		torrentManager.log().Warn("ignoring resume data", "err", err)
+	}
+
+	err = diskManager.ScaffoldFiles()
+	if err != nil {
+		return nil, fmt.Errorf("scaffolding files: %w", err)
+	}
+
+	if config.Recheck {
+		_, err = torrentManager.Recheck()
+		if err != nil {
+			diskManager.Close()
+			return nil, fmt.Errorf("recheck: %w", err)
+		}
+	}
+
+	return &Torrent{manager: torrentManager}, nil
+}
+
+// Torrent returns the torrent with the given (hex) info hash, nil when it
+// wasn't added
+func (c *Client) Torrent(infoHash string) *Torrent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.torrents[infoHash]
+}
+
+// Torrents returns every torrent added and not removed
+func (c *Client) Torrents() []*Torrent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	torrents := make([]*Torrent, 0, len(c.torrents))
+	for _, t := range c.torrents {
+		torrents = append(torrents, t)
+	}
+	return torrents
+}
+
+// RemoveTorrent stops a torrent and forgets it. Its data stays on disk.
+func (c *Client) RemoveTorrent(infoHash string) error {
+	c.mu.Lock()
+	t, ok := c.torrents[infoHash]
+	delete(c.torrents, infoHash)
+	c.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("torrent %s not found", infoHash)
+	}
+	return t.Stop()
+}
+
+// Subscribe returns a subscription to the events of every torrent, see
+// Event. buffer is how many events can wait to be read before new ones are
+// dropped, 0 for a default.
+func (c *Client) Subscribe(buffer int) *Subscription {
+	return c.events.subscribe("", buffer)
+}
+
+// Close stops listening and stops every torrent, see Torrent.Stop. Event
+// subscriptions are closed once the torrents' last events are sent.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	torrents := c.torrents
+	c.torrents = nil
+	c.mu.Unlock()
+
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.conns.Wait()
+
+	// Independent of each other, stop them all at once
+	var wg sync.WaitGroup
+	errs := make(chan error, len(torrents))
+	for _, t := range torrents {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := t.Stop()
+			if err != nil {
+				errs <- fmt.Errorf("stopping %s: %w", t.InfoHash(), err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	c.events.close()
+
+	var err error
+	for stopErr := range errs {
+		err = errors.Join(err, stopErr)
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+package torrent
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientAddSameTorrentConcurrently(t *testing.T) {
+	tracker := newFakeTracker(t)
+	tfi, _ := newTestTorrent(t, "file.bin", testPieceLength, []testFile{{length: 4 * testPieceLength}}, tracker.URL)
+
+	baseline := runtime.NumGoroutine()
+	client, err := NewClient(Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription := client.Subscribe(1024)
+
+	const adders = 8
+	torrents := make(chan *Torrent, adders)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for range adders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			torrent, err := client.AddTorrentBytes(tfi.TorrentFile.Data, TorrentConfig{})
+			if err == nil {
+				torrents <- torrent
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(torrents)
+
+	added := 0
+	for torrent := range torrents {
+		added++
+		if state := torrent.State(); state != StateRunning {
+			t.Fatalf("added torrent is %s, want %s", state, StateRunning)
+		}
+	}
+	if added != 1 {
+		t.Fatalf("torrent was added %d times, want once", added)
+	}
+	if torrents := client.Torrents(); len(torrents) != 1 {
+		t.Fatalf("client has %d torrents, want 1", len(torrents))
+	}
+
+	// Losers never got as far as setting a torrent up, so there was none
+	// to stop (and have it save its resume data over the winner's)
+	subscription.Close()
+	for event := range subscription.Events() {
+		if changed, ok := event.(StateChanged); ok && changed.To == StateStopped {
+			t.Fatal("a torrent was stopped while adding")
+		}
+	}
+
+	within(t, 2*time.Second, "Close", func() { client.Close() })
+	checkGoroutines(t, baseline)
+}
+
+func TestClientAddWhileAdding(t *testing.T) {
+	tracker := newFakeTracker(t)
+	tfi, _ := newTestTorrent(t, "file.bin", testPieceLength, []testFile{{length: 4 * testPieceLength}}, tracker.URL)
+
+	dir := t.TempDir()
+	client, err := NewClient(Config{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// As if another Add were still scaffolding it
+	client.mu.Lock()
+	client.adding[tfi.InfoHash] = true
+	client.mu.Unlock()
+
+	_, err = client.AddTorrentBytes(tfi.TorrentFile.Data, TorrentConfig{})
+	if err == nil {
+		t.Fatal("adding a torrent that's being added worked")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Fatalf("second add touched the save path: %v", entries)
+	}
+
+	client.mu.Lock()
+	delete(client.adding, tfi.InfoHash)
+	client.mu.Unlock()
+	_, err = client.AddTorrentBytes(tfi.TorrentFile.Data, TorrentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,190 +2,652 @@ package torrent
 
 import (
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sync"
 )
 
-const basePath = "./asdf/"
+// Used when DiskManager.SavePath isn't set
+const defaultSavePath = "./asdf/"
 
+// Defaults for DiskManager.WriteWorkers and how many received blocks can
+// wait for a worker before the event loop has to wait too
+const defaultWriteWorkers = 4
+const writeQueueLength = 64
+
+// filesMap is the torrent's file layout. Shared by disk manager, which
+// changes it (priorities, files getting created), and the storage reading
+// and writing through it.
 type filesMap struct {
-	filesData []fileData
+	filesData    []fileData
+	partFilePath string
+	pieceLength  int64
+	totalLength  int64
+	mu           sync.RWMutex
 }
 
 type fileData struct {
+	// where the file is right now, finalPath once it's complete (or when
+	// incomplete files aren't kept apart)
 	filePath    string
+	finalPath   string
 	fileSize    int64
 	offsetStart int64
 	offsetEnd   int64
+	priority    Priority
+	// false for skipped files that were never created, their bytes (from
+	// pieces shared with wanted files) go to the part file instead
+	created bool
+	// file was already on disk with the right size when scaffolding, i.e.
+	// data from a previous run can be trusted to be there
+	existed bool
 }
 
 // Maybe no need to pass the whole ref, just pass info(pass by value)
 type DiskManager struct {
 	TorrentFileInfo *TorrentFileInfo
-	mu              sync.Mutex
-	filesMap        *filesMap
-	BlockWrittenBus *BlockWrittenBus
+	// Directory the torrent is saved in. Multi-file torrents get a
+	// subdirectory named after the torrent.
+	SavePath string
+	// Initial priority per file index (order of the torrent's files list).
+	// Files not in the map are normal priority.
+	FilePriorities map[int]Priority
+	// Storage backend for this torrent, file storage when empty. Ignored if
+	// Storage is set directly.
+	StorageType StorageType
+	Storage     Storage
+	// How files get their space on disk, sparse when empty
+	Allocation Allocation
+	// Files are written under IncompleteDir (same layout as under
+	// SavePath) and/or with PartSuffix appended to their name until every
+	// piece of them is verified, then moved to their final path. Keeps
+	// watchers on SavePath from picking up half written files.
+	IncompleteDir string
+	PartSuffix    bool
+	// Go routines writing blocks to storage, defaultWriteWorkers when zero
+	WriteWorkers int
+	// Caps storage writes in flight across every torrent sharing it,
+	// optional
+	DiskWorkers *DiskWorkers
+	writeQueue  chan *blockResponse
+	writers     sync.WaitGroup
+	stopWriters sync.Once
+	// Budget for buffering whole pieces in memory before writing them.
+	// Share one between torrents for a global budget. A default sized one
+	// is created when nil.
+	WriteCache *WriteCache
+	buffers    map[int]*pieceBuffer
+	buffersMu  sync.Mutex
+	filesMap   *filesMap
+	// held for reading around every storage read/write, Move takes it for
+	// writing to pause I/O while files change places
+	ioMu sync.RWMutex
+	// SavePath is read while running (resume data, Files) and Move changes
+	// it, both go through savePath/setSavePath
+	savePathMu sync.RWMutex
+	// Nothing is logged when nil
+	Logger          *slog.Logger
+	blockWrittenBus *blockWrittenBus
 }
 
-func (diskManager *DiskManager) saveBlock(blockResponse *BlockResponse) {
-	diskManager.mu.Lock()
-	defer diskManager.mu.Unlock()
+func (diskManager *DiskManager) log() *slog.Logger {
+	return loggerOr(diskManager.Logger)
+}
 
-	fmt.Printf(" Writing block to disk (piece=%d, block=%d, size=%d bytes)\n",
-		blockResponse.pieceIndex, blockResponse.blockIndex, len(blockResponse.blockData))
+// startWriters starts the pool of go routines draining the write queue
+func (diskManager *DiskManager) startWriters() {
+	workers := diskManager.WriteWorkers
+	if workers <= 0 {
+		workers = defaultWriteWorkers
+	}
 
-	offset := diskManager.TorrentFileInfo.PieceLength*int64(blockResponse.pieceIndex) + int64(blockResponse.blockIndex)*blockLength
-	var pathToWrite string
-	var fileOffset int64
+	if diskManager.WriteCache == nil {
+		diskManager.WriteCache = NewWriteCache(defaultCacheBudget)
+	}
+	diskManager.buffers = make(map[int]*pieceBuffer)
 
-	for _, fileData := range diskManager.filesMap.filesData {
-		if (offset >= fileData.offsetStart) && (offset < fileData.offsetEnd) {
-			pathToWrite = fileData.filePath
-			fileOffset = offset - fileData.offsetStart
-		}
+	diskManager.writeQueue = make(chan *blockResponse, writeQueueLength)
+	for range workers {
+		diskManager.writers.Add(1)
+		go func() {
+			defer diskManager.writers.Done()
+			for response := range diskManager.writeQueue {
+				diskManager.saveBlock(response)
+			}
+		}()
 	}
+}
+
+// DiskWorkers limits how many storage writes run at once. Every torrent of
+// a client shares one so they don't drown the disk (or each other) in
+// writes. A nil one doesn't limit anything.
+type DiskWorkers struct {
+	slots chan struct{}
+}
+
+// NewDiskWorkers allows n writes at a time, defaultWriteWorkers when n is
+// zero or less
+func NewDiskWorkers(n int) *DiskWorkers {
+	if n <= 0 {
+		n = defaultWriteWorkers
+	}
+	return &DiskWorkers{slots: make(chan struct{}, n)}
+}
 
-	file, err := os.OpenFile(pathToWrite, os.O_RDWR, 0777)
+func (workers *DiskWorkers) acquire() {
+	if workers != nil {
+		workers.slots <- struct{}{}
+	}
+}
+
+func (workers *DiskWorkers) release() {
+	if workers != nil {
+		<-workers.slots
+	}
+}
+
+// Writes go through storage with positional I/O, no lock needed here.
+// Blocks never overlap so concurrent writers can't clobber each other.
+func (diskManager *DiskManager) saveBlock(response *blockResponse) {
+	diskManager.log().Debug("writing block",
+		"piece", response.pieceIndex, "block", response.blockIndex, "bytes", len(response.blockData))
+
+	// Either buffered until the piece is complete or written directly
+	err := diskManager.writeBlock(int(response.pieceIndex), int(response.blockIndex), response.blockData)
 	if err != nil {
-		fmt.Printf("❌ Error opening file %s: %v\n", pathToWrite, err)
-		diskManager.BlockWrittenBus.BlockWritten <- &BlockWritten{
-			pieceIndex: blockResponse.pieceIndex,
-			blockIndex: blockResponse.blockIndex,
-			success:    false,
-			err:        err,
-		}
-		return
+		diskManager.log().Error("failed to write block",
+			"piece", response.pieceIndex, "block", response.blockIndex, "err", err)
 	}
-	defer file.Close()
 
-	_, err = file.Seek(fileOffset, 0)
+	diskManager.blockWrittenBus.written <- &blockWritten{
+		pieceIndex: response.pieceIndex,
+		blockIndex: response.blockIndex,
+		success:    err == nil,
+		err:        err,
+	}
+}
+
+// ScaffoldFiles lays out the torrent's files under the save path and opens
+// the storage. Fails before anything is created when the save path isn't
+// writable or the torrent's paths can't be laid out safely. In-memory
+// storage doesn't touch the disk at all.
+func (diskManager *DiskManager) ScaffoldFiles() error {
+	fileType := diskManager.TorrentFileInfo.Mode
+	if fileType != single && fileType != multi {
+		panic("FileType has to be single or multi")
+	}
+
+	filesMap, err := diskManager.buildFilesMap()
 	if err != nil {
-		fmt.Printf("❌ Error seeking in file %s at offset %d: %v\n", pathToWrite, fileOffset, err)
-		diskManager.BlockWrittenBus.BlockWritten <- &BlockWritten{
-			pieceIndex: blockResponse.pieceIndex,
-			blockIndex: blockResponse.blockIndex,
-			success:    false,
-			err:        err,
+		return fmt.Errorf("torrent can't be safely saved: %w", err)
+	}
+	diskManager.filesMap = filesMap
+
+	if diskManager.StorageType != StorageMemory {
+		err = diskManager.ValidateSavePath()
+		if err != nil {
+			return err
+		}
+		err = diskManager.checkFreeSpace()
+		if err != nil {
+			return err
 		}
-		return
+
+		diskManager.log().Info("scaffolding files", "mode", fileType, "dir", diskManager.savePath())
+		for i := range filesMap.filesData {
+			err = diskManager.scaffoldFile(&filesMap.filesData[i])
+			if err != nil {
+				return fmt.Errorf("creating %s: %w", filesMap.filesData[i].filePath, err)
+			}
+		}
+	}
+
+	err = diskManager.openStorage()
+	if err != nil {
+		return err
+	}
+	diskManager.startWriters()
+	return nil
+}
+
+// MapFiles builds the file layout for data that is already on disk without
+// creating, resizing or checking anything. Used to verify a directory.
+func (diskManager *DiskManager) MapFiles() error {
+	filesMap, err := diskManager.buildFilesMap()
+	if err != nil {
+		return fmt.Errorf("torrent can't be safely laid out: %w", err)
+	}
+
+	for i := range filesMap.filesData {
+		filesMap.filesData[i].created = true
+		filesMap.filesData[i].existed = true
 	}
+	diskManager.filesMap = filesMap
+
+	return diskManager.openStorage()
+}
 
-	bytesWritten, err := file.Write(blockResponse.blockData)
+// buildFilesMap works out where every file goes and its byte range within
+// the torrent. Nothing on disk is touched.
+func (diskManager *DiskManager) buildFilesMap() (*filesMap, error) {
+	layout, err := layoutFiles(diskManager.TorrentFileInfo.Info, diskManager.TorrentFileInfo.Mode)
 	if err != nil {
-		fmt.Printf("❌ Error writing to file %s: %v\n", pathToWrite, err)
-		diskManager.BlockWrittenBus.BlockWritten <- &BlockWritten{
-			pieceIndex: blockResponse.pieceIndex,
-			blockIndex: blockResponse.blockIndex,
-			success:    false,
-			err:        err,
+		return nil, err
+	}
+
+	savePath := diskManager.savePath()
+	incompleteDir := diskManager.incompleteDir()
+	filesMap := &filesMap{
+		partFilePath: diskManager.partFilePath(),
+		pieceLength:  diskManager.TorrentFileInfo.PieceLength,
+		totalLength:  diskManager.TorrentFileInfo.FileLength,
+	}
+
+	lastOffsetEnd := int64(0)
+	for i, file := range layout {
+		fullPath := filepath.Join(savePath, file.path)
+		if !insideDir(savePath, fullPath) {
+			return nil, fmt.Errorf("file %d resolves outside of %s", i, savePath)
 		}
-		return
+		incompletePath := diskManager.incompletePath(file.path)
+		if !insideDir(incompleteDir, incompletePath) {
+			return nil, fmt.Errorf("file %d resolves outside of %s", i, incompleteDir)
+		}
+
+		priority, ok := diskManager.FilePriorities[i]
+		if !ok {
+			priority = PriorityNormal
+		}
+
+		filesMap.filesData = append(filesMap.filesData, fileData{
+			filePath:    currentPath(incompletePath, fullPath),
+			finalPath:   fullPath,
+			fileSize:    file.length,
+			offsetStart: lastOffsetEnd,
+			offsetEnd:   lastOffsetEnd + file.length,
+			priority:    priority,
+		})
+		lastOffsetEnd = lastOffsetEnd + file.length
 	}
+	return filesMap, nil
+}
 
-	fmt.Printf(" Successfully wrote %d bytes to %s at offset %d\n", bytesWritten, pathToWrite, fileOffset)
+func (diskManager *DiskManager) openStorage() error {
+	if diskManager.Storage != nil {
+		return nil
+	}
 
-	// Send success event
-	diskManager.BlockWrittenBus.BlockWritten <- &BlockWritten{
-		pieceIndex: blockResponse.pieceIndex,
-		blockIndex: blockResponse.blockIndex,
-		success:    true,
-		err:        nil,
+	storage, err := newStorage(diskManager.StorageType, diskManager.filesMap)
+	if err != nil {
+		return err
 	}
+	diskManager.Storage = storage
+	return nil
 }
 
-func (diskManager *DiskManager) ScaffoldFiles() {
-	fileType := diskManager.TorrentFileInfo.Mode
-	filesMap := &filesMap{}
-	diskManager.filesMap = filesMap
+// ReadPiece reads a whole piece from storage
+func (diskManager *DiskManager) ReadPiece(index int) ([]byte, error) {
+	pieceStart := diskManager.TorrentFileInfo.PieceLength * int64(index)
+	pieceEnd := min(pieceStart+diskManager.TorrentFileInfo.PieceLength, diskManager.TorrentFileInfo.FileLength)
+	if index < 0 || pieceStart >= pieceEnd {
+		return nil, fmt.Errorf("piece %d not found", index)
+	}
 
-	// Create base directory if it doesn't exist
-	err := os.MkdirAll(basePath, 0777)
+	buf := make([]byte, pieceEnd-pieceStart)
+	_, err := diskManager.readAt(index, buf, 0)
 	if err != nil {
-		fmt.Printf("❌ Failed to create base directory %s: %v\n", basePath, err)
-		return
+		return nil, err
 	}
+	return buf, nil
+}
+
+func (diskManager *DiskManager) readAt(piece int, p []byte, offset int64) (int, error) {
+	diskManager.ioMu.RLock()
+	defer diskManager.ioMu.RUnlock()
+	return diskManager.Storage.ReadAt(piece, p, offset)
+}
 
-	fmt.Printf("\n Scaffolding files (mode: %s)...\n", fileType)
+func (diskManager *DiskManager) writeAt(piece int, p []byte, offset int64) (int, error) {
+	diskManager.DiskWorkers.acquire()
+	defer diskManager.DiskWorkers.release()
 
-	switch fileType {
-	case "single":
-		fileName := diskManager.TorrentFileInfo.Info["name"].(string)
-		fileSize, ok := diskManager.TorrentFileInfo.Info["length"].(int64)
-		fullPath := fmt.Sprintf("%s%s", basePath, fileName)
-		if !ok {
-			fmt.Println("❌ File size has to be present")
-			return
+	diskManager.ioMu.RLock()
+	defer diskManager.ioMu.RUnlock()
+	return diskManager.Storage.WriteAt(piece, p, offset)
+}
+
+// MarkComplete tells storage every block of the piece is in
+func (diskManager *DiskManager) MarkComplete(index int) error {
+	return diskManager.Storage.MarkComplete(index)
+}
+
+// Close stops the writers, flushes buffered blocks and releases the
+// storage. Nothing may be queued for writing any more.
+func (diskManager *DiskManager) Close() error {
+	diskManager.stopWriters.Do(func() {
+		if diskManager.writeQueue != nil {
+			close(diskManager.writeQueue)
+			diskManager.writers.Wait()
+		}
+	})
+	if diskManager.Storage == nil {
+		return nil
+	}
+
+	err := diskManager.Flush()
+	if err != nil {
+		return err
+	}
+	return diskManager.Storage.Close()
+}
+
+// Sync makes sure everything written so far is on disk (not just in the
+// OS cache). Files written through a mapping are covered too, their dirty
+// pages belong to the file.
+func (diskManager *DiskManager) Sync() error {
+	if diskManager.filesMap == nil || diskManager.StorageType == StorageMemory {
+		return nil
+	}
+	diskManager.filesMap.mu.RLock()
+	paths := []string{diskManager.filesMap.partFilePath}
+	for _, fileData := range diskManager.filesMap.filesData {
+		if fileData.created {
+			paths = append(paths, fileData.filePath)
+		}
+	}
+	diskManager.filesMap.mu.RUnlock()
+
+	for _, path := range paths {
+		file, err := os.OpenFile(path, os.O_RDWR, 0)
+		if os.IsNotExist(err) {
+			continue
 		}
-		err := createFile(fullPath, int(fileSize))
 		if err != nil {
-			return
-		}
-		fileData := fileData{
-			filePath:    fullPath,
-			fileSize:    fileSize,
-			offsetStart: 0,
-			offsetEnd:   fileSize,
-		}
-		filesMap.filesData = append(filesMap.filesData, fileData)
-	case "multi":
-		files := diskManager.TorrentFileInfo.Info["files"]
-
-		lastOffsetEnd := int64(0)
-		for _, file := range files.([]any) {
-			f := file.(map[string]any)
-			fileSize := f["length"].(int64)
-
-			// Get path - it's an array of path components
-			pathComponents, ok := f["path"].([]any)
-			if !ok {
-				continue
-			}
+			return err
+		}
+		err = file.Sync()
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("syncing %s: %w", path, err)
+		}
+	}
+	return nil
+}
 
-			// Build path from components
-			pathParts := make([]string, len(pathComponents))
-			for i, component := range pathComponents {
-				pathParts[i] = component.(string)
-			}
-			path := filepath.Join(pathParts...)
+type filePieces struct {
+	path        string
+	first, last int // piece indexes, last < first for zero-length files
+}
 
-			fullPath := filepath.Join(basePath, path)
-			os.MkdirAll(filepath.Dir(fullPath), 0777)
-			err := createFile(fullPath, int(fileSize))
-			if err != nil {
-				continue
-			}
+// filePieces returns the range of pieces overlapping every file
+func (diskManager *DiskManager) filePieces() []filePieces {
+	diskManager.filesMap.mu.RLock()
+	defer diskManager.filesMap.mu.RUnlock()
 
-			fileData := fileData{
-				filePath:    fullPath,
-				fileSize:    fileSize,
-				offsetStart: lastOffsetEnd,
-				offsetEnd:   lastOffsetEnd + fileSize,
-			}
-			lastOffsetEnd = lastOffsetEnd + fileSize
-			filesMap.filesData = append(filesMap.filesData, fileData)
+	pieceLength := diskManager.TorrentFileInfo.PieceLength
+	var files []filePieces
+	for _, fileData := range diskManager.filesMap.filesData {
+		file := filePieces{
+			path:  fileData.filePath,
+			first: int(fileData.offsetStart / pieceLength),
+			last:  int(fileData.offsetStart/pieceLength) - 1,
 		}
-	default:
-		panic("FileType has to be single or multi")
+		if fileData.fileSize > 0 {
+			file.last = int((fileData.offsetEnd - 1) / pieceLength)
+		}
+		files = append(files, file)
 	}
+	return files
 }
 
-func createFile(filePath string, fileSize int) error {
-	// Create the file
-	file, err := os.Create(filePath)
+// ValidateSavePath creates the save path (and incomplete directory) if
+// needed and checks we can actually write there, so a bad path fails before
+// the download starts rather than on the first block.
+func (diskManager *DiskManager) ValidateSavePath() error {
+	for _, dir := range []string{diskManager.savePath(), diskManager.incompleteDir()} {
+		err := os.MkdirAll(dir, 0777)
+		if err != nil {
+			return fmt.Errorf("creating save path %s: %w", dir, err)
+		}
+
+		probe, err := os.CreateTemp(dir, ".write-check-*")
+		if err != nil {
+			return fmt.Errorf("save path %s is not writable: %w", dir, err)
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+	}
+	return nil
+}
+
+func (diskManager *DiskManager) savePath() string {
+	diskManager.savePathMu.RLock()
+	defer diskManager.savePathMu.RUnlock()
+
+	if diskManager.SavePath == "" {
+		return defaultSavePath
+	}
+	return diskManager.SavePath
+}
+
+func (diskManager *DiskManager) setSavePath(savePath string) {
+	diskManager.savePathMu.Lock()
+	defer diskManager.savePathMu.Unlock()
+
+	diskManager.SavePath = savePath
+}
+
+// scaffoldFile creates the file unless it is skipped
+func (diskManager *DiskManager) scaffoldFile(fileData *fileData) error {
+	if fileData.priority == PrioritySkip {
+		diskManager.log().Debug("skipping file", "file", fileData.filePath)
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(fileData.filePath), 0777)
 	if err != nil {
-		fmt.Printf("❌ Failed to create file %s: %v\n", filePath, err)
 		return err
 	}
-	defer file.Close()
+	existed, err := diskManager.createFile(fileData.filePath, fileData.fileSize, diskManager.allocation())
+	if err != nil {
+		return err
+	}
+	fileData.created = true
+	fileData.existed = existed
+	return nil
+}
+
+// SetFilePriority changes a file's priority while downloading. A skipped
+// file that becomes wanted is created and seeded with whatever the part
+// file already holds for it. A file already on disk stays there when
+// skipped, we just stop asking for its pieces.
+func (diskManager *DiskManager) SetFilePriority(index int, priority Priority) error {
+	if diskManager.filesMap == nil {
+		return fmt.Errorf("file %d not found", index)
+	}
+	// Reads and writes wait until the file holds what the part file had,
+	// until then they'd find it empty
+	diskManager.ioMu.Lock()
+	defer diskManager.ioMu.Unlock()
+	diskManager.filesMap.mu.Lock()
+	defer diskManager.filesMap.mu.Unlock()
 
-	// create a file of size n
-	err = file.Truncate(int64(fileSize))
+	if index < 0 || index >= len(diskManager.filesMap.filesData) {
+		return fmt.Errorf("file %d not found", index)
+	}
+	fileData := &diskManager.filesMap.filesData[index]
+	fileData.priority = priority
+
+	// Nothing to create for in-memory storage
+	if priority == PrioritySkip || fileData.created || diskManager.StorageType == StorageMemory {
+		return nil
+	}
+
+	os.MkdirAll(filepath.Dir(fileData.filePath), 0777)
+	_, err := diskManager.createFile(fileData.filePath, fileData.fileSize, diskManager.allocation())
 	if err != nil {
-		fmt.Printf("❌ Failed to set file size for %s: %v\n", filePath, err)
 		return err
 	}
+	fileData.created = true
 
-	fmt.Printf(" Created file: %s (size: %d bytes)\n", filePath, fileSize)
-	return nil
+	return diskManager.copyFromPartFile(fileData)
+}
+
+// copyFromPartFile moves bytes already downloaded for a previously skipped
+// file from the part file into the file itself
+func (diskManager *DiskManager) copyFromPartFile(fileData *fileData) error {
+	partFile, err := os.Open(diskManager.partFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer partFile.Close()
+
+	file, err := os.OpenFile(fileData.filePath, os.O_RDWR, 0777)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, io.NewSectionReader(partFile, fileData.offsetStart, fileData.fileSize))
+	return err
+}
+
+// pieceFilePriority is the highest priority among files the piece overlaps.
+// A piece shared by a skipped and a wanted file still has to be downloaded.
+func (diskManager *DiskManager) pieceFilePriority(index int) Priority {
+	if diskManager.filesMap == nil {
+		return PriorityNormal
+	}
+	diskManager.filesMap.mu.RLock()
+	defer diskManager.filesMap.mu.RUnlock()
+
+	pieceStart := diskManager.TorrentFileInfo.PieceLength * int64(index)
+	pieceEnd := min(pieceStart+diskManager.TorrentFileInfo.PieceLength, diskManager.TorrentFileInfo.FileLength)
+
+	priority := PrioritySkip
+	for _, fileData := range diskManager.filesMap.filesData {
+		if fileData.offsetStart < pieceEnd && fileData.offsetEnd > pieceStart {
+			priority = max(priority, fileData.priority)
+		}
+	}
+	return priority
+}
+
+// fileRange returns where a file's bytes are within the torrent
+func (diskManager *DiskManager) fileRange(index int) (int64, int64, error) {
+	if diskManager.filesMap == nil {
+		return 0, 0, fmt.Errorf("file %d not found", index)
+	}
+	diskManager.filesMap.mu.RLock()
+	defer diskManager.filesMap.mu.RUnlock()
+
+	if index < 0 || index >= len(diskManager.filesMap.filesData) {
+		return 0, 0, fmt.Errorf("file %d not found", index)
+	}
+	fileData := diskManager.filesMap.filesData[index]
+	return fileData.offsetStart, fileData.fileSize, nil
+}
+
+// FilePriorityMap returns the current priority of every file by index
+func (diskManager *DiskManager) FilePriorityMap() map[int]Priority {
+	if diskManager.filesMap == nil {
+		return diskManager.FilePriorities
+	}
+	diskManager.filesMap.mu.RLock()
+	defer diskManager.filesMap.mu.RUnlock()
+
+	priorities := make(map[int]Priority, len(diskManager.filesMap.filesData))
+	for index, fileData := range diskManager.filesMap.filesData {
+		priorities[index] = fileData.priority
+	}
+	return priorities
+}
+
+// pieceOnDisk reports whether data from a previous run can still be there
+// for the piece: every file it overlaps was reused rather than created
+// fresh. Skipped files live in the part file, which has to exist. Nothing
+// survives a restart with in-memory storage.
+func (diskManager *DiskManager) pieceOnDisk(index int) bool {
+	if diskManager.StorageType == StorageMemory {
+		return false
+	}
+	diskManager.filesMap.mu.RLock()
+	defer diskManager.filesMap.mu.RUnlock()
+
+	pieceStart := diskManager.TorrentFileInfo.PieceLength * int64(index)
+	pieceEnd := min(pieceStart+diskManager.TorrentFileInfo.PieceLength, diskManager.TorrentFileInfo.FileLength)
+
+	_, err := os.Stat(diskManager.partFilePath())
+	partFileExists := err == nil
+
+	for _, fileData := range diskManager.filesMap.filesData {
+		if fileData.offsetStart >= pieceEnd || fileData.offsetEnd <= pieceStart {
+			continue
+		}
+		if fileData.created && !fileData.existed {
+			return false
+		}
+		if !fileData.created && !partFileExists {
+			return false
+		}
+	}
+	return true
+}
+
+func (diskManager *DiskManager) allocation() Allocation {
+	if diskManager.Allocation == "" {
+		return AllocateSparse
+	}
+	return diskManager.Allocation
+}
+
+func (diskManager *DiskManager) resumeFilePath() string {
+	return filepath.Join(diskManager.savePath(), "."+diskManager.TorrentFileInfo.InfoHash+".resume")
+}
+
+func (diskManager *DiskManager) partFilePath() string {
+	return filepath.Join(diskManager.savePath(), "."+diskManager.TorrentFileInfo.InfoHash+".parts")
+}
+
+// createFile creates the file and allocates its space. An existing file is
+// reused as is (only resized when the size is off) so data from a previous
+// run survives. existed tells the caller whether there was one. With no
+// allocation a shorter file is the normal state of a partial download.
+func (diskManager *DiskManager) createFile(filePath string, fileSize int64, allocation Allocation) (bool, error) {
+	info, statErr := os.Stat(filePath)
+	existed := statErr == nil
+	currentSize := int64(0)
+	if existed {
+		currentSize = info.Size()
+	}
+
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0777)
+	if err != nil {
+		diskManager.log().Error("failed to create file", "file", filePath, "err", err)
+		return false, err
+	}
+	defer file.Close()
+
+	if existed && (currentSize == fileSize || allocation == AllocateNone && currentSize < fileSize) {
+		diskManager.log().Debug("reusing file", "file", filePath, "size", currentSize)
+		return true, nil
+	}
+
+	err = allocateFile(file, currentSize, fileSize, allocation)
+	if err != nil {
+		diskManager.log().Error("failed to allocate file", "file", filePath, "err", err)
+		return false, err
+	}
+
+	if existed {
+		diskManager.log().Debug("resized file", "file", filePath, "size", fileSize, "allocation", allocation)
+		return false, nil
+	}
+	diskManager.log().Debug("created file", "file", filePath, "size", fileSize, "allocation", allocation)
+	return false, nil
 }
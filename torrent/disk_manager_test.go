@@ -0,0 +1,26 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScaffoldFilesReportsCreateError(t *testing.T) {
+	tfi, _ := newTestTorrent(t, "data", 16, []testFile{
+		{path: []string{"a.bin"}, length: 10},
+		{path: []string{"sub", "b.bin"}, length: 20},
+	}, "http://127.0.0.1:1/announce")
+
+	// sub can't be a directory, b.bin can't be created
+	savePath := t.TempDir()
+	os.MkdirAll(filepath.Join(savePath, "data"), 0777)
+	os.WriteFile(filepath.Join(savePath, "data", "sub"), nil, 0666)
+
+	diskManager := &DiskManager{TorrentFileInfo: &tfi, SavePath: savePath}
+	err := diskManager.ScaffoldFiles()
+	if err == nil {
+		diskManager.Close()
+		t.Fatal("scaffolding worked with a file in the way")
+	}
+}
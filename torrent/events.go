@@ -0,0 +1,205 @@
+package torrent
+
+import (
+	"sync"
+)
+
+// Event is something that happened to a torrent, one of the types below.
+// Subscribers switch on the type:
+//
+//	for event := range subscription.Events() {
+//		switch event := event.(type) {
+//		case torrent.PieceCompleted:
+//			...
+//		}
+//	}
+type Event interface {
+	isEvent()
+}
+
+// PieceCompleted is sent once a piece is verified and stored
+type PieceCompleted struct {
+	InfoHash string
+	Piece    int
+	// Verified pieces and pieces of wanted files, after this one
+	Done   int
+	Wanted int
+}
+
+// PieceHashFailed is sent when a piece doesn't match its hash, it's
+// downloaded again
+type PieceHashFailed struct {
+	InfoHash string
+	Piece    int
+	Err      error
+}
+
+// PeerConnected is sent once a peer finished the handshake, Incoming when
+// it connected to us
+type PeerConnected struct {
+	InfoHash string
+	Addr     string
+	Incoming bool
+}
+
+// PeerDisconnected is sent when a connected peer goes away. Err is nil when
+// we closed the connection (pause, stop).
+type PeerDisconnected struct {
+	InfoHash string
+	Addr     string
+	Err      error
+}
+
+// TrackerAnnounced is sent when a tracker answered an announce. Event is
+// the announce's event: started, completed or stopped.
+type TrackerAnnounced struct {
+	InfoHash string
+	Tracker  string
+	Event    string
+	Peers    int
+}
+
+// TrackerError is sent when an announce failed
+type TrackerError struct {
+	InfoHash string
+	Tracker  string
+	Event    string
+	Err      error
+}
+
+// TorrentCompleted is sent once every wanted piece is in
+type TorrentCompleted struct {
+	InfoHash string
+}
+
+// StorageError is sent when writing or finishing data failed. Piece is -1
+// when it isn't about a single piece.
+type StorageError struct {
+	InfoHash string
+	Piece    int
+	Err      error
+}
+
+// StateChanged is sent when a torrent goes from one State* to another
+type StateChanged struct {
+	InfoHash string
+	From     string
+	To       string
+}
+
+func (PieceCompleted) isEvent()   {}
+func (PieceHashFailed) isEvent()  {}
+func (PeerConnected) isEvent()    {}
+func (PeerDisconnected) isEvent() {}
+func (TrackerAnnounced) isEvent() {}
+func (TrackerError) isEvent()     {}
+func (TorrentCompleted) isEvent() {}
+func (StorageError) isEvent()     {}
+func (StateChanged) isEvent()     {}
+
+// Buffer of subscriptions asking for 0 or less
+const defaultEventBuffer = 256
+
+// eventBus hands events to every subscription. Publishing never blocks the
+// download: a subscription whose buffer is full misses the event.
+type eventBus struct {
+	subscriptions map[*Subscription]struct{}
+	closed        bool
+	mu            sync.Mutex
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscriptions: make(map[*Subscription]struct{})}
+}
+
+// Subscription receives events until it's closed
+type Subscription struct {
+	events chan Event
+	// only this torrent's events when set
+	infoHash string
+	dropped  int64
+	bus      *eventBus
+}
+
+// subscribe adds a subscription, to one torrent's events when infoHash is
+// set. It's returned closed when the bus is.
+func (bus *eventBus) subscribe(infoHash string, buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = defaultEventBuffer
+	}
+	subscription := &Subscription{
+		events:   make(chan Event, buffer),
+		infoHash: infoHash,
+		bus:      bus,
+	}
+
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if bus.closed {
+		close(subscription.events)
+		return subscription
+	}
+	bus.subscriptions[subscription] = struct{}{}
+	return subscription
+}
+
+// publish sends an event about a torrent to its subscriptions. A nil bus
+// (managers wired without a Client) drops everything.
+func (bus *eventBus) publish(infoHash string, event Event) {
+	if bus == nil {
+		return
+	}
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	for subscription := range bus.subscriptions {
+		if subscription.infoHash != "" && subscription.infoHash != infoHash {
+			continue
+		}
+		select {
+		case subscription.events <- event:
+		default:
+			subscription.dropped++
+		}
+	}
+}
+
+// close ends every subscription, later ones start closed
+func (bus *eventBus) close() {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	for subscription := range bus.subscriptions {
+		close(subscription.events)
+	}
+	bus.subscriptions = nil
+	bus.closed = true
+}
+
+// Events is where the events come in. It's closed by Close, and when the
+// client is closed.
+func (subscription *Subscription) Events() <-chan Event {
+	return subscription.events
+}
+
+// Dropped is how many events were missed because the buffer was full
+func (subscription *Subscription) Dropped() int64 {
+	subscription.bus.mu.Lock()
+	defer subscription.bus.mu.Unlock()
+
+	return subscription.dropped
+}
+
+// Close stops the subscription and closes its channel, events already
+// buffered can still be read
+func (subscription *Subscription) Close() {
+	bus := subscription.bus
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	if _, ok := bus.subscriptions[subscription]; !ok {
+		return
+	}
+	delete(bus.subscriptions, subscription)
+	close(subscription.events)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 
@@ -12,6 +13,8 @@ import (
 
 type TorrentFile struct {
 	Path string
+	// Contents of the torrent file, read from Path when nil
+	Data []byte
 }
 
 type TorrentFileInfo struct {
@@ -22,7 +25,8 @@ type TorrentFileInfo struct {
 	Mode        fileType
 	PieceLength int64
 	TotalPieces int64
-	FileLength  int64 // Total length of all files
+	FileLength  int64      // Total length of all files
+	PieceHashes [][20]byte // SHA-1 of every piece, from info["pieces"]
 }
 
 func (t TorrentFile) SetTorrentFileInfo() (TorrentFileInfo, error) {
@@ -88,6 +92,19 @@ func (t TorrentFile) SetTorrentFileInfo() (TorrentFileInfo, error) {
 
 	numberOfPieces := (fileLength + pieceLength - 1) / pieceLength // clever math trick to get ceil value
 
+	// pieces is a string of concatenated 20 byte SHA-1 hashes
+	pieces, ok := info["pieces"].(string)
+	if !ok || len(pieces)%20 != 0 {
+		return tfi, fmt.Errorf("Pieces has to be a string of 20 byte hashes")
+	}
+	if int64(len(pieces)/20) != numberOfPieces {
+		return tfi, fmt.Errorf("Torrent has %d piece hashes but %d pieces", len(pieces)/20, numberOfPieces)
+	}
+	pieceHashes := make([][20]byte, numberOfPieces)
+	for i := range pieceHashes {
+		copy(pieceHashes[i][:], pieces[i*20:(i+1)*20])
+	}
+
 	tfi.TorrentFile = &t
 	tfi.Info = info
 	tfi.InfoHash = infoHash
@@ -96,6 +113,7 @@ func (t TorrentFile) SetTorrentFileInfo() (TorrentFileInfo, error) {
 	tfi.PieceLength = pieceLength
 	tfi.TotalPieces = numberOfPieces
 	tfi.FileLength = fileLength
+	tfi.PieceHashes = pieceHashes
 
 	return tfi, nil
 }
@@ -190,12 +208,16 @@ func (t TorrentFile) FileMode(info map[string]any) fileType {
 }
 
 func (t TorrentFile) Parse() (map[string]any, error) {
-	file, err := os.Open(t.Path)
-	if err != nil {
-		return nil, err
+	var reader io.Reader = bytes.NewReader(t.Data)
+	if t.Data == nil {
+		file, err := os.Open(t.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
 	}
-	defer file.Close()
-	data, err := bencode.Decode(file)
+	data, err := bencode.Decode(reader)
 	if err != nil {
 		return nil, err
 	}
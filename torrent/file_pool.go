@@ -0,0 +1,153 @@
+package torrent
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Default number of file handles file storage keeps open
+const defaultMaxOpenFiles = 64
+
+// filePool keeps recently used files open so a 16 KiB block doesn't cost an
+// open/close pair. Least recently used handles are closed once more than
+// maxOpen are open, but never while somebody is still using them, so the
+// pool can go over the limit for a moment under load.
+type filePool struct {
+	maxOpen int
+	files   map[string]*list.Element
+	lru     *list.List // front is most recently used, values are *pooledFile
+	mu      sync.Mutex
+}
+
+type pooledFile struct {
+	path     string
+	file     *os.File
+	writable bool
+	refs     int
+	// forgotten by the pool while in use, closed on the last release
+	forgotten bool
+}
+
+func newFilePool(maxOpen int) *filePool {
+	if maxOpen <= 0 {
+		maxOpen = defaultMaxOpenFiles
+	}
+	return &filePool{
+		maxOpen: maxOpen,
+		files:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// acquire returns an open handle for path, release it when done. Writers
+// pass create so missing files (the part file) get created, readers never
+// create anything. Files we can't write to are opened read-only.
+func (pool *filePool) acquire(path string, create bool) (*pooledFile, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if element, ok := pool.files[path]; ok {
+		pooled := element.Value.(*pooledFile)
+		// A reader got it read-only (e.g. before a Move made it writable),
+		// writers get it opened again
+		if !create || pooled.writable {
+			pool.lru.MoveToFront(element)
+			pooled.refs++
+			return pooled, nil
+		}
+		pool.forgetElement(element)
+	}
+
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	file, err := os.OpenFile(path, flags, 0777)
+	writable := err == nil
+	if !create && (errors.Is(err, fs.ErrPermission) || errors.Is(err, syscall.EROFS)) {
+		file, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+
+	pooled := &pooledFile{path: path, file: file, writable: writable, refs: 1}
+	pool.files[path] = pool.lru.PushFront(pooled)
+	pool.evict()
+	return pooled, nil
+}
+
+func (pool *filePool) release(pooled *pooledFile) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pooled.refs--
+	if pooled.forgotten && pooled.refs == 0 {
+		pooled.file.Close()
+	}
+	pool.evict()
+}
+
+// forget drops the handle for path (the file is being moved or removed),
+// the next acquire opens it again. A handle still in use is closed once
+// it's released.
+func (pool *filePool) forget(path string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	element, ok := pool.files[path]
+	if !ok {
+		return
+	}
+	pool.forgetElement(element)
+}
+
+// forgetElement is forget for callers holding pool.mu
+func (pool *filePool) forgetElement(element *list.Element) {
+	pooled := element.Value.(*pooledFile)
+	pool.lru.Remove(element)
+	delete(pool.files, pooled.path)
+	if pooled.refs == 0 {
+		pooled.file.Close()
+	} else {
+		pooled.forgotten = true
+	}
+}
+
+// evict closes idle handles from the back until we're within maxOpen.
+// Caller holds pool.mu
+func (pool *filePool) evict() {
+	element := pool.lru.Back()
+	for pool.lru.Len() > pool.maxOpen && element != nil {
+		previous := element.Prev()
+		pooled := element.Value.(*pooledFile)
+		if pooled.refs == 0 {
+			pooled.file.Close()
+			pool.lru.Remove(element)
+			delete(pool.files, pooled.path)
+		}
+		element = previous
+	}
+}
+
+// Close closes every handle, even ones in use
+func (pool *filePool) Close() error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var firstErr error
+	for path, element := range pool.files {
+		err := element.Value.(*pooledFile).file.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(pool.files, path)
+	}
+	pool.lru.Init()
+	return firstErr
+}
@@ -0,0 +1,66 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilePoolWriterReopensReadOnlyHandle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	err := os.WriteFile(path, []byte("hello"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := newFilePool(4)
+	defer pool.Close()
+
+	// What a reader gets when the file wasn't writable at the time
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOnly := &pooledFile{path: path, file: file}
+	pool.files[path] = pool.lru.PushFront(readOnly)
+
+	reader, err := pool.acquire(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader != readOnly {
+		t.Fatal("reader didn't get the cached handle")
+	}
+
+	writer, err := pool.acquire(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !writer.writable {
+		t.Fatal("writer got a read-only handle")
+	}
+	_, err = writer.file.WriteAt([]byte("j"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.release(writer)
+
+	// The reader still holds the old handle, it's closed once released
+	if !readOnly.forgotten {
+		t.Fatal("read-only handle wasn't dropped from the pool")
+	}
+	pool.release(reader)
+	_, err = readOnly.file.Stat()
+	if err == nil {
+		t.Fatal("read-only handle wasn't closed on its last release")
+	}
+
+	again, err := pool.acquire(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.release(again)
+	if again != writer {
+		t.Fatal("reader didn't get the writable handle")
+	}
+}
@@ -0,0 +1,29 @@
+//go:build linux || darwin
+
+package torrent
+
+import (
+	"os"
+	"syscall"
+)
+
+// freeSpace is how many bytes an unprivileged user can still write to the
+// volume holding path
+func freeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// allocatedSize is how much of the volume a file really uses, sparse files
+// and files truncated to their final size count only their written blocks
+func allocatedSize(info os.FileInfo) int64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.Size()
+	}
+	return int64(stat.Blocks) * 512
+}
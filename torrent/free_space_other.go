@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package torrent
+
+import "os"
+
+func freeSpace(path string) (int64, error) {
+	return 0, errFreeSpaceUnknown
+}
+
+// Without block counts a file is taken to be as big as it looks
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
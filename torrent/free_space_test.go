@@ -0,0 +1,42 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestAllocatedSizeOfSparseFile(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("no block counts on", runtime.GOOS)
+	}
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	const size = 64 << 20
+	err = allocateFile(file, 0, size, AllocateSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteAt(make([]byte, 4096), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != size {
+		t.Fatalf("file is %d bytes, want %d", info.Size(), size)
+	}
+	// A filesystem without sparse files would allocate it all
+	if allocated := allocatedSize(info); allocated >= size {
+		t.Fatalf("sparse file uses %d bytes, expected less than %d", allocated, size)
+	}
+}
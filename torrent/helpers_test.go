@@ -0,0 +1,317 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// testFile is one file of a torrent built by newTestTorrent
+type testFile struct {
+	path   []string
+	length int
+}
+
+// newTestTorrent builds a torrent over generated content. A single file
+// makes a single file torrent named name, more make a multi-file one
+// under the name directory.
+func newTestTorrent(t *testing.T, name string, pieceLength int, files []testFile, announce string) (TorrentFileInfo, []byte) {
+	t.Helper()
+
+	total := 0
+	for _, file := range files {
+		total += file.length
+	}
+	content := make([]byte, total)
+	for i := range content {
+		content[i] = byte(i*7 + 3)
+	}
+
+	var pieces []byte
+	for offset := 0; offset < total; offset += pieceLength {
+		sum := sha1.Sum(content[offset:min(offset+pieceLength, total)])
+		pieces = append(pieces, sum[:]...)
+	}
+
+	info := map[string]any{"name": name, "piece length": pieceLength, "pieces": string(pieces)}
+	if len(files) == 1 {
+		info["length"] = files[0].length
+	} else {
+		var list []any
+		for _, file := range files {
+			var path []any
+			for _, part := range file.path {
+				path = append(path, part)
+			}
+			list = append(list, map[string]any{"length": file.length, "path": path})
+		}
+		info["files"] = list
+	}
+
+	var data bytes.Buffer
+	err := bencode.Marshal(&data, map[string]any{"announce": announce, "info": info})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tfi, err := TorrentFile{Data: data.Bytes()}.SetTorrentFileInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tfi, content
+}
+
+// fakeTracker answers announces over HTTP with a fixed list of peers
+type fakeTracker struct {
+	URL   string
+	peers []*net.TCPAddr
+	// query of every announce so far
+	announces []url.Values
+	mu        sync.Mutex
+}
+
+func newFakeTracker(t *testing.T) *fakeTracker {
+	tracker := &fakeTracker{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tracker.mu.Lock()
+		tracker.announces = append(tracker.announces, r.URL.Query())
+		var peers []byte
+		for _, addr := range tracker.peers {
+			peers = append(peers, addr.IP.To4()...)
+			peers = binary.BigEndian.AppendUint16(peers, uint16(addr.Port))
+		}
+		tracker.mu.Unlock()
+
+		// No keep-alive, idle connections would count as leaked go routines
+		w.Header().Set("Connection", "close")
+		bencode.Marshal(w, map[string]any{"interval": 60, "peers": string(peers)})
+	}))
+	t.Cleanup(server.Close)
+	tracker.URL = server.URL + "/announce"
+	return tracker
+}
+
+// startedAnnounces returns the query of every started announce so far
+func (tracker *fakeTracker) startedAnnounces() []url.Values {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	var started []url.Values
+	for _, query := range tracker.announces {
+		if query.Get("event") == "started" {
+			started = append(started, query)
+		}
+	}
+	return started
+}
+
+func (tracker *fakeTracker) setPeers(listeners ...net.Listener) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	tracker.peers = nil
+	for _, listener := range listeners {
+		tracker.peers = append(tracker.peers, listener.Addr().(*net.TCPAddr))
+	}
+}
+
+// fakeSeeder has every piece of content
+type fakeSeeder struct {
+	infoHash    []byte
+	content     []byte
+	pieceLength int
+	// blocks sent over every connection
+	sent atomic.Int64
+	// once holdAfter blocks were sent the next ones wait for hold to be
+	// closed, nil hold never holds anything
+	holdAfter int64
+	hold      chan struct{}
+	// the chokeAt-th request (counting from 1, 0 never) is answered with a
+	// choke and an unchoke instead of its block, like a seeder rotating
+	// the peers it uploads to
+	chokeAt  int64
+	requests atomic.Int64
+}
+
+// newFakeSeeder serves every piece of content. Once holdAfter blocks were
+// sent (over every connection) the next ones wait for hold to be closed,
+// nil hold never holds anything.
+func newFakeSeeder(t *testing.T, tfi *TorrentFileInfo, content []byte, holdAfter int64, hold chan struct{}) net.Listener {
+	return serveFakeSeeder(t, tfi, &fakeSeeder{content: content, holdAfter: holdAfter, hold: hold})
+}
+
+// newChokingSeeder serves every piece of content but chokes us instead of
+// answering the chokeAt-th request, then unchokes us right away
+func newChokingSeeder(t *testing.T, tfi *TorrentFileInfo, content []byte, chokeAt int64) net.Listener {
+	return serveFakeSeeder(t, tfi, &fakeSeeder{content: content, chokeAt: chokeAt})
+}
+
+func serveFakeSeeder(t *testing.T, tfi *TorrentFileInfo, seeder *fakeSeeder) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	seeder.infoHash, _ = hex.DecodeString(tfi.InfoHash)
+	seeder.pieceLength = int(tfi.PieceLength)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go seeder.serve(conn)
+		}
+	}()
+	return listener
+}
+
+func (seeder *fakeSeeder) serve(conn net.Conn) {
+	defer conn.Close()
+
+	handshake := make([]byte, 68)
+	_, err := io.ReadFull(conn, handshake)
+	if err != nil {
+		return
+	}
+	reply := make([]byte, 68)
+	copy(reply, handshake[:20])
+	copy(reply[28:48], seeder.infoHash)
+	copy(reply[48:], "-FS0001-000000000000")
+	conn.Write(reply)
+
+	send := func(id byte, payload []byte) error {
+		message := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)))
+		message = append(message, id)
+		_, err := conn.Write(append(message, payload...))
+		return err
+	}
+	content := seeder.content
+	pieces := (len(content) + seeder.pieceLength - 1) / seeder.pieceLength
+	bitfield := make([]byte, (pieces+7)/8)
+	for i := range pieces {
+		bitfield[i/8] |= 1 << (7 - uint(i%8))
+	}
+	send(5, bitfield)
+	send(1, nil)
+
+	for {
+		id, payload, err := readPeerMessage(conn)
+		if err != nil {
+			return
+		}
+		if id != 6 || len(payload) != 12 {
+			continue
+		}
+		// Choking drops the request, it's never answered
+		if seeder.requests.Add(1) == seeder.chokeAt {
+			send(0, nil)
+			send(1, nil)
+			continue
+		}
+		index := int(binary.BigEndian.Uint32(payload[0:4]))
+		begin := int(binary.BigEndian.Uint32(payload[4:8]))
+		length := int(binary.BigEndian.Uint32(payload[8:12]))
+		if seeder.hold != nil && seeder.sent.Add(1) > seeder.holdAfter {
+			<-seeder.hold
+		}
+		offset := index*seeder.pieceLength + begin
+		if send(7, append(payload[0:8:8], content[offset:offset+length]...)) != nil {
+			return
+		}
+	}
+}
+
+// newSilentPeer accepts connections and never answers them. accepted gets
+// a value for every connection.
+func newSilentPeer(t *testing.T) (net.Listener, chan struct{}) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	accepted := make(chan struct{}, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return listener, accepted
+}
+
+// within fails the test when fn takes longer than timeout
+func within(t *testing.T, timeout time.Duration, name string, fn func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("%s didn't return within %s", name, timeout)
+	}
+}
+
+// checkGoroutines waits for the number of go routines to get back to
+// baseline, dumping them all when it doesn't
+func checkGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		// A dial finishing after its announce was cancelled leaves an idle
+		// connection in the transport's pool, that's not ours to wait for
+		trackerHTTPClient.CloseIdleConnections()
+		if time.Now().After(deadline) {
+			stacks := make([]byte, 1<<20)
+			stacks = stacks[:runtime.Stack(stacks, true)]
+			t.Fatalf("%d go routines left, %d before:\n%s", runtime.NumGoroutine(), baseline, stacks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForEvent reads events until match says yes, failing after timeout
+func waitForEvent(t *testing.T, subscription *Subscription, timeout time.Duration, match func(Event) bool) {
+	t.Helper()
+
+	timer := time.After(timeout)
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				t.Fatal("subscription closed")
+			}
+			if match(event) {
+				return
+			}
+		case <-timer:
+			t.Fatal("event didn't come in time")
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StreamServer serves a torrent's files over HTTP while they download.
+// GET / lists the files, GET /files/<index>/<path> streams one with Range
+// support, so a media player can seek around. The ranges being read are
+// downloaded first (see Torrent.NewReader), a request waits for pieces that
+// aren't in yet.
+type StreamServer struct {
+	Torrent *Torrent
+	// Nothing is logged when nil
+	Logger   *slog.Logger
+	mux      *http.ServeMux
+	initOnce sync.Once
+}
+
+func (server *StreamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.initOnce.Do(func() {
+		server.mux = http.NewServeMux()
+		server.mux.HandleFunc("GET /{$}", server.serveIndex)
+		server.mux.HandleFunc("GET /files/{index}/{path...}", server.serveFile)
+	})
+	server.mux.ServeHTTP(w, r)
+}
+
+func (server *StreamServer) serveIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<!doctype html>\n<ul>")
+	for _, file := range server.Torrent.Files() {
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a> (%d bytes)</li>\n",
+			html.EscapeString(fileURL(file)), html.EscapeString(file.Path), file.Length)
+	}
+	fmt.Fprintln(w, "</ul>")
+}
+
+func (server *StreamServer) serveFile(w http.ResponseWriter, r *http.Request) {
+	// The path is only there for players that go by the URL's extension,
+	// it has to be the file's
+	index, err := strconv.Atoi(r.PathValue("index"))
+	files := server.Torrent.Files()
+	if err != nil || index < 0 || index >= len(files) || r.PathValue("path") != files[index].Path {
+		http.NotFound(w, r)
+		return
+	}
+	file := files[index]
+
+	reader, err := server.Torrent.NewReader(index)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer reader.Close()
+
+	// A client that gives up shouldn't leave us waiting on its pieces
+	stop := context.AfterFunc(r.Context(), func() { reader.Close() })
+	defer stop()
+
+	// Set the type up front, otherwise ServeContent sniffs it which means
+	// waiting for the first piece before sending any headers
+	contentType := mime.TypeByExtension(path.Ext(file.Path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	loggerOr(server.Logger).Info("streaming file",
+		"file", index, "range", r.Header.Get("Range"), "client", r.RemoteAddr)
+	http.ServeContent(w, r, path.Base(file.Path), time.Time{}, reader)
+}
+
+// fileURL is where StreamServer serves the file
+func fileURL(file File) string {
+	return "/files/" + strconv.Itoa(file.Index) + "/" + (&url.URL{Path: file.Path}).EscapedPath()
+}
@@ -0,0 +1,70 @@
+package torrent
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStreamServerServeFile(t *testing.T) {
+	tracker := newFakeTracker(t)
+	tfi, content := newTestTorrent(t, "data", testPieceLength, []testFile{
+		{path: []string{"notes.txt"}, length: 1000},
+		{path: []string{"sub", "movie.mp4"}, length: 2*testPieceLength + 500},
+	}, tracker.URL)
+	tracker.setPeers(newFakeSeeder(t, &tfi, content, 0, nil))
+
+	client, err := NewClient(Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	torrent, err := client.AddTorrentBytes(tfi.TorrentFile.Data, TorrentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(&StreamServer{Torrent: torrent})
+	defer server.Close()
+
+	tests := []struct {
+		url         string
+		status      int
+		contentType string
+		body        []byte
+	}{
+		{"/files/1/data/sub/movie.mp4", http.StatusOK, "video/mp4", content[1000:]},
+		{"/files/0/data/notes.txt", http.StatusOK, "text/plain; charset=utf-8", content[:1000]},
+		// The type comes from the file, not from whatever the URL says
+		{"/files/0/data/notes.mp4", http.StatusNotFound, "", nil},
+		{"/files/1/data/notes.txt", http.StatusNotFound, "", nil},
+		{"/files/2/data/sub/movie.mp4", http.StatusNotFound, "", nil},
+		{"/files/-1/data/notes.txt", http.StatusNotFound, "", nil},
+		{"/files/x/data/notes.txt", http.StatusNotFound, "", nil},
+	}
+
+	for _, test := range tests {
+		response, err := http.Get(server.URL + test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != test.status {
+			t.Fatalf("%s: status %d, want %d", test.url, response.StatusCode, test.status)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if contentType := response.Header.Get("Content-Type"); contentType != test.contentType {
+			t.Fatalf("%s: Content-Type %q, want %q", test.url, contentType, test.contentType)
+		}
+		if !bytes.Equal(body, test.body) {
+			t.Fatalf("%s: body doesn't match the file", test.url)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Appended to file names until they're complete when PartSuffix is set
+const partSuffix = ".part"
+
+// fileMover is implemented by storages that hold on to files by path (open
+// handles, mappings) and need to know when one gets moved
+type fileMover interface {
+	moveFile(oldPath, newPath string) error
+}
+
+func (diskManager *DiskManager) incompleteDir() string {
+	if diskManager.IncompleteDir == "" {
+		return diskManager.savePath()
+	}
+	return diskManager.IncompleteDir
+}
+
+// incompletePath is where a file with the given path (relative to the save
+// path) is written until it's complete
+func (diskManager *DiskManager) incompletePath(relativePath string) string {
+	path := filepath.Join(diskManager.incompleteDir(), relativePath)
+	if diskManager.PartSuffix {
+		path += partSuffix
+	}
+	return path
+}
+
+// currentPath picks where a file is right now. A file only found at its
+// final path was completed (and moved) by a previous run.
+func currentPath(incompletePath, finalPath string) string {
+	if incompletePath == finalPath {
+		return finalPath
+	}
+	_, err := os.Stat(incompletePath)
+	if os.IsNotExist(err) {
+		_, err = os.Stat(finalPath)
+		if err == nil {
+			return finalPath
+		}
+	}
+	return incompletePath
+}
+
+// CompleteFiles moves every file whose pieces are all in bitfield from its
+// incomplete path to its final one. Files that were never created (skipped,
+// their bytes are in the part file) stay where they are. Storage I/O waits
+// while files are moved, that's a rename unless the incomplete directory is
+// on another volume.
+func (diskManager *DiskManager) CompleteFiles(bitfield []byte) error {
+	if diskManager.filesMap == nil || diskManager.StorageType == StorageMemory {
+		return nil
+	}
+
+	pieceLength := diskManager.TorrentFileInfo.PieceLength
+	// Like Move, a reader that found the old path mustn't open it after the
+	// file is gone (mmap storage would create it again, empty)
+	diskManager.ioMu.Lock()
+	defer diskManager.ioMu.Unlock()
+	diskManager.filesMap.mu.Lock()
+	defer diskManager.filesMap.mu.Unlock()
+
+	for i := range diskManager.filesMap.filesData {
+		fileData := &diskManager.filesMap.filesData[i]
+		if !fileData.created || fileData.filePath == fileData.finalPath {
+			continue
+		}
+
+		complete := true
+		if fileData.fileSize > 0 {
+			first := int(fileData.offsetStart / pieceLength)
+			last := int((fileData.offsetEnd - 1) / pieceLength)
+			for index := first; index <= last && complete; index++ {
+				complete = bitfieldHas(bitfield, index)
+			}
+		}
+		if !complete {
+			continue
+		}
+
+		err := diskManager.moveToFinalPath(fileData)
+		if err != nil {
+			return fmt.Errorf("moving %s to %s: %w", fileData.filePath, fileData.finalPath, err)
+		}
+		diskManager.log().Info("file complete", "file", fileData.finalPath)
+	}
+	return nil
+}
+
+// moveToFinalPath moves a complete file and points the file map at its new
+// location. Caller holds filesMap.mu
+func (diskManager *DiskManager) moveToFinalPath(fileData *fileData) error {
+	err := os.MkdirAll(filepath.Dir(fileData.finalPath), 0777)
+	if err != nil {
+		return err
+	}
+
+	err = diskManager.relocate(fileData.filePath, fileData.finalPath)
+	if err != nil {
+		return err
+	}
+
+	fileData.filePath = fileData.finalPath
+	return nil
+}
+
+// relocate moves a file storage may have open
+func (diskManager *DiskManager) relocate(oldPath, newPath string) error {
+	if mover, ok := diskManager.Storage.(fileMover); ok {
+		return mover.moveFile(oldPath, newPath)
+	}
+	return renameOrCopy(oldPath, newPath)
+}
+
+// renameOrCopy renames oldPath to newPath, copying and removing the
+// original when a rename isn't possible (different volumes)
+func renameOrCopy(oldPath, newPath string) error {
+	renameErr := os.Rename(oldPath, newPath)
+	if renameErr == nil {
+		return nil
+	}
+
+	src, err := os.Open(oldPath)
+	if err != nil {
+		return renameErr
+	}
+	defer src.Close()
+
+	// Copy under a temporary name so the final path never holds half a file
+	tmpPath := newPath + partSuffix
+	dst, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, newPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	src.Close()
+	return os.Remove(oldPath)
+}
+
+// Handles on the old path are dropped first, renaming a file that's open
+// fails on windows
+func (storage *fileStorage) moveFile(oldPath, newPath string) error {
+	storage.pool.forget(oldPath)
+	return renameOrCopy(oldPath, newPath)
+}
@@ -0,0 +1,96 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompleteFilesWhileReading(t *testing.T) {
+	for _, storageType := range []StorageType{StorageFile, StorageMmap} {
+		t.Run(string(storageType), func(t *testing.T) {
+			var files []testFile
+			for i := range 32 {
+				files = append(files, testFile{path: []string{fmt.Sprintf("file%d.bin", i)}, length: 40})
+			}
+			tfi, content := newTestTorrent(t, "data", 16, files, "http://127.0.0.1:1/announce")
+
+			savePath, incompleteDir := t.TempDir(), t.TempDir()
+			diskManager := &DiskManager{
+				TorrentFileInfo: &tfi,
+				SavePath:        savePath,
+				IncompleteDir:   incompleteDir,
+				PartSuffix:      true,
+				StorageType:     storageType,
+			}
+			err := diskManager.ScaffoldFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer diskManager.Close()
+
+			pieces := (len(content) + 15) / 16
+			for piece := range pieces {
+				_, err = diskManager.writeAt(piece, content[piece*16:min((piece+1)*16, len(content))], 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			bitfield := make([]byte, (pieces+7)/8)
+			for piece := range pieces {
+				bitfield[piece/8] |= 1 << (7 - uint(piece%8))
+			}
+
+			// A reader must find every file, at the old path or the new one,
+			// and never bring an old path back
+			stop := make(chan struct{})
+			readErr := make(chan error, 1)
+			go func() {
+				defer close(readErr)
+				for {
+					for piece := range pieces {
+						data, err := diskManager.ReadPiece(piece)
+						if err != nil {
+							readErr <- err
+							return
+						}
+						if !bytes.Equal(data, content[piece*16:min((piece+1)*16, len(content))]) {
+							readErr <- fmt.Errorf("piece %d changed while completing", piece)
+							return
+						}
+					}
+					select {
+					case <-stop:
+						return
+					default:
+					}
+				}
+			}()
+			err = diskManager.CompleteFiles(bitfield)
+			close(stop)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-readErr; err != nil {
+				t.Fatal(err)
+			}
+
+			for i := range files {
+				path := filepath.Join(savePath, "data", fmt.Sprintf("file%d.bin", i))
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, content[i*40:(i+1)*40]) {
+					t.Fatalf("%s doesn't hold its data", path)
+				}
+			}
+			left, _ := filepath.Glob(filepath.Join(incompleteDir, "data", "*"+partSuffix))
+			if len(left) > 0 {
+				t.Fatalf("incomplete files left behind: %v", left)
+			}
+		})
+	}
+}
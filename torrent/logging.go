@@ -0,0 +1,23 @@
+package torrent
+
+import (
+	"log/slog"
+)
+
+// Components log through the *slog.Logger they're given, nothing is
+// printed when they're given none. The Client hands each torrent's
+// components a logger carrying the torrent's infohash and the component's
+// name, peers add their address on top. Per block and per message lines
+// are Debug, what a user may care about is Info, things going wrong are
+// Warn (we carry on) or Error (something is lost).
+
+// Used by components that weren't given a logger
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// loggerOr returns logger, or one dropping everything when it's nil
+func loggerOr(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return discardLogger
+	}
+	return logger
+}
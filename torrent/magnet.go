@@ -0,0 +1,426 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Magnet links only carry the info hash, the info dictionary (file names,
+// piece hashes...) is fetched from peers with the metadata extension
+// (BEP 9) on top of the extension protocol (BEP 10).
+const (
+	// the info dictionary is sent in pieces of this size
+	metadataPieceSize = 16 * 1024
+	// bigger info dictionaries are refused
+	maxMetadataSize = 16 * 1024 * 1024
+	// how long one peer gets to hand the whole thing over
+	metadataTimeout = 30 * time.Second
+	// peers asked at the same time
+	metadataPeers = 10
+	// our id for ut_metadata messages, sent in our extension handshake
+	utMetadataID = 1
+	// extension protocol message, its first payload byte says which one
+	extendedMessageID = 20
+)
+
+var errNoMetadata = errors.New("peer doesn't share metadata")
+
+// magnet is what a magnet link tells us
+type magnet struct {
+	infoHash string // hex
+	name     string
+	trackers []tracker
+	length   int64 // xl, 0 when the link doesn't say
+}
+
+// parseMagnet reads magnet:?xt=urn:btih:<hash>&dn=<name>&xl=<length>&tr=<tracker>...
+// The hash can be hex or base32.
+func parseMagnet(uri string) (magnet, error) {
+	var m magnet
+
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "magnet" {
+		return m, fmt.Errorf("not a magnet link: %s", uri)
+	}
+	query := parsed.Query()
+
+	for _, xt := range query["xt"] {
+		hash, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		switch len(hash) {
+		case 40:
+			_, err = hex.DecodeString(hash)
+			m.infoHash = strings.ToLower(hash)
+		case 32:
+			var raw []byte
+			raw, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+			m.infoHash = hex.EncodeToString(raw)
+		default:
+			err = fmt.Errorf("info hash has %d characters", len(hash))
+		}
+		if err != nil {
+			return m, fmt.Errorf("invalid info hash %q: %v", hash, err)
+		}
+	}
+	if m.infoHash == "" {
+		return m, fmt.Errorf("magnet link has no btih info hash")
+	}
+
+	m.name = query.Get("dn")
+	if xl := query.Get("xl"); xl != "" {
+		m.length, err = strconv.ParseInt(xl, 10, 64)
+		if err != nil || m.length < 0 {
+			return m, fmt.Errorf("invalid exact length %q", xl)
+		}
+	}
+	for _, tr := range query["tr"] {
+		if strings.HasPrefix(tr, "http") {
+			m.trackers = append(m.trackers, tracker{Kind: "http", Url: tr})
+		} else if strings.HasPrefix(tr, "udp") {
+			m.trackers = append(m.trackers, tracker{Kind: "udp", Url: tr})
+		}
+	}
+	return m, nil
+}
+
+// AddMagnet fetches the torrent's info dictionary from peers found through
+// the link's trackers, then adds it like AddTorrentFile. It blocks until
+// the metadata is in, some peer has to have it.
+func (c *Client) AddMagnet(ctx context.Context, uri string, config TorrentConfig) (*Torrent, error) {
+	m, err := parseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+	// We've got no DHT, trackers are the only way to find peers
+	if len(m.trackers) == 0 {
+		return nil, fmt.Errorf("magnet link has no http or udp trackers")
+	}
+	if c.Torrent(m.infoHash) != nil {
+		return nil, fmt.Errorf("torrent %s already added", m.infoHash)
+	}
+
+	// Give up when the client closes
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(c.ctx, cancel)
+	defer stop()
+
+	c.logger.Info("fetching metadata", "infohash", m.infoHash, "name", m.name)
+	metadata, err := c.fetchMetadata(ctx, m)
+	if err != nil {
+		if c.ctx.Err() != nil {
+			return nil, ErrClientClosed
+		}
+		return nil, fmt.Errorf("fetching metadata: %w", err)
+	}
+
+	data, err := magnetTorrentFile(m, metadata)
+	if err != nil {
+		return nil, err
+	}
+	tfi, err := TorrentFile{Data: data}.SetTorrentFileInfo()
+	if err != nil {
+		return nil, fmt.Errorf("parsing metadata: %w", err)
+	}
+	// Re-encoding changed the info dictionary (it wasn't canonical)
+	if tfi.InfoHash != m.infoHash {
+		return nil, fmt.Errorf("metadata can't be re-encoded to info hash %s", m.infoHash)
+	}
+	return c.addTorrent("", &tfi, config)
+}
+
+// magnetTorrentFile builds the torrent file the magnet link stands for
+func magnetTorrentFile(m magnet, metadata []byte) ([]byte, error) {
+	info, err := bencode.Decode(bytes.NewReader(metadata))
+	if err != nil {
+		return nil, fmt.Errorf("decoding metadata: %w", err)
+	}
+
+	var announceList []any
+	for _, tracker := range m.trackers {
+		announceList = append(announceList, []any{tracker.Url})
+	}
+
+	var buf bytes.Buffer
+	err = bencode.Marshal(&buf, map[string]any{
+		"info":          info,
+		"announce-list": announceList,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fetchMetadata asks the trackers for peers and the peers for metadata,
+// several at once. The first complete and verified copy wins.
+func (c *Client) fetchMetadata(ctx context.Context, m magnet) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	infoHash, _ := hex.DecodeString(m.infoHash)
+	trackerManager := &TrackerManager{Infohash: m.infoHash, PeerID: c.config.PeerID, Port: c.port()}
+	// Nothing downloaded yet and, without xl, no idea how much is left.
+	// Saying 0 left would make us a seed to the tracker, which then keeps
+	// other seeds from us.
+	left := max(m.length, 1)
+
+	var wg sync.WaitGroup
+	addrs := make(chan string)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(addrs)
+
+		seen := make(map[string]bool)
+		for _, tracker := range m.trackers {
+			peers, err := tracker.Peers(ctx, m.infoHash, trackerManager.announceRequest("started", 0, left))
+			if err != nil {
+				c.logger.Warn("announce failed", "infohash", m.infoHash, "tracker", tracker.Url, "err", err)
+				continue
+			}
+			for _, peer := range peers {
+				addr := peer.Addr()
+				if seen[addr] {
+					continue
+				}
+				seen[addr] = true
+				select {
+				case addrs <- addr:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	var (
+		metadata []byte
+		lastErr  error = fmt.Errorf("trackers gave us no peers")
+		mu       sync.Mutex
+	)
+	for range metadataPeers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for addr := range addrs {
+				data, err := metadataFromPeer(ctx, addr, infoHash, c.config.PeerID)
+
+				mu.Lock()
+				if err == nil && metadata == nil {
+					metadata = data
+					cancel()
+				} else if err != nil && ctx.Err() == nil {
+					lastErr = fmt.Errorf("%s: %w", addr, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if metadata != nil {
+		return metadata, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, lastErr
+}
+
+// metadataFromPeer connects to a peer and downloads the info dictionary
+// from it, checking it against the info hash
+func metadataFromPeer(ctx context.Context, addr string, infoHash []byte, peerID string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// Same handshake as for downloading, plus the extension protocol bit
+	handshake := make([]byte, 68)
+	handshake[0] = 19
+	copy(handshake[1:20], "BitTorrent protocol")
+	handshake[25] |= 0x10
+	copy(handshake[28:48], infoHash)
+	copy(handshake[48:68], peerID)
+	_, err = conn.Write(handshake)
+	if err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, 68)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(response[28:48], infoHash) {
+		return nil, fmt.Errorf("peer answered for another torrent")
+	}
+	if response[25]&0x10 == 0 {
+		return nil, errNoMetadata
+	}
+
+	err = writeExtended(conn, 0, map[string]any{
+		"m": map[string]any{"ut_metadata": utMetadataID},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata []byte
+	var received []bool
+	remaining := 0
+	for {
+		id, payload, err := readPeerMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if id != extendedMessageID || len(payload) == 0 {
+			continue
+		}
+
+		dict, data, err := decodeExtended(payload[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		switch payload[0] {
+		case 0: // their extension handshake
+			if metadata != nil {
+				continue
+			}
+			extensions, _ := dict["m"].(map[string]any)
+			theirID, _ := extensions["ut_metadata"].(int64)
+			size, _ := dict["metadata_size"].(int64)
+			if theirID == 0 || size <= 0 {
+				return nil, errNoMetadata
+			}
+			if size > maxMetadataSize {
+				return nil, fmt.Errorf("metadata too big: %d bytes", size)
+			}
+
+			metadata = make([]byte, size)
+			pieces := int((size + metadataPieceSize - 1) / metadataPieceSize)
+			received = make([]bool, pieces)
+			remaining = pieces
+			for piece := range pieces {
+				err = writeExtended(conn, byte(theirID), map[string]any{"msg_type": 0, "piece": piece})
+				if err != nil {
+					return nil, err
+				}
+			}
+		case utMetadataID:
+			msgType, _ := dict["msg_type"].(int64)
+			piece, _ := dict["piece"].(int64)
+			if msgType == 2 {
+				return nil, fmt.Errorf("peer rejected metadata piece %d", piece)
+			}
+			if msgType != 1 || metadata == nil || piece < 0 || int(piece) >= len(received) {
+				continue
+			}
+
+			offset := int(piece) * metadataPieceSize
+			length := min(metadataPieceSize, len(metadata)-offset)
+			if len(data) != length {
+				return nil, fmt.Errorf("metadata piece %d has %d bytes, expected %d", piece, len(data), length)
+			}
+			if !received[piece] {
+				copy(metadata[offset:], data)
+				received[piece] = true
+				remaining--
+			}
+
+			if remaining == 0 {
+				if sum := sha1.Sum(metadata); !bytes.Equal(sum[:], infoHash) {
+					return nil, fmt.Errorf("metadata doesn't match the info hash")
+				}
+				return metadata, nil
+			}
+		}
+	}
+}
+
+// writeExtended sends an extension protocol message:
+// <len><id=20><extended id><bencoded dict>
+func writeExtended(conn net.Conn, extendedID byte, dict map[string]any) error {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 0, extendedMessageID, extendedID})
+	err := bencode.Marshal(&buf, dict)
+	if err != nil {
+		return err
+	}
+	message := buf.Bytes()
+	binary.BigEndian.PutUint32(message[0:4], uint32(len(message)-4))
+	_, err = conn.Write(message)
+	return err
+}
+
+// readPeerMessage reads one message, skipping keep-alives
+func readPeerMessage(conn net.Conn) (byte, []byte, error) {
+	for {
+		lengthBuf := make([]byte, 4)
+		_, err := io.ReadFull(conn, lengthBuf)
+		if err != nil {
+			return 0, nil, err
+		}
+		length := binary.BigEndian.Uint32(lengthBuf)
+		if length == 0 {
+			continue
+		}
+		// Nothing we ask for comes close, don't let a peer make us
+		// allocate gigabytes
+		if length > maxMetadataSize {
+			return 0, nil, fmt.Errorf("message too big: %d bytes", length)
+		}
+
+		message := make([]byte, length)
+		_, err = io.ReadFull(conn, message)
+		if err != nil {
+			return 0, nil, err
+		}
+		return message[0], message[1:], nil
+	}
+}
+
+// decodeExtended decodes the bencoded dict at the start of an extension
+// message. Metadata pieces come right after it, they're returned as well.
+func decodeExtended(payload []byte) (map[string]any, []byte, error) {
+	reader := bytes.NewReader(payload)
+	buffered := bufio.NewReader(reader)
+	value, err := bencode.Decode(buffered)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding extension message: %w", err)
+	}
+	dict, ok := value.(map[string]any)
+	if !ok {
+		return nil, nil, fmt.Errorf("extension message isn't a dictionary")
+	}
+
+	consumed := len(payload) - reader.Len() - buffered.Buffered()
+	return dict, payload[consumed:], nil
+}
@@ -0,0 +1,133 @@
+package torrent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Move moves the torrent's data (files, part file, resume data) under a new
+// save path while it's running. Storage I/O is paused meanwhile, writers
+// and readers just wait. Files are renamed, or copied and deleted when the
+// new path is on another volume. Piece state is kept so there's no recheck
+// afterwards. Files still in the incomplete directory stay there, they'll
+// be moved to the new path once complete.
+//
+// Nothing is moved when one of the destinations already exists. When a
+// file can't be moved the ones already moved are put back and the torrent
+// keeps its old save path.
+func (diskManager *DiskManager) Move(newSavePath string) error {
+	diskManager.ioMu.Lock()
+	defer diskManager.ioMu.Unlock()
+
+	oldSavePath := diskManager.savePath()
+	if filepath.Clean(newSavePath) == filepath.Clean(oldSavePath) {
+		return nil
+	}
+	if diskManager.StorageType == StorageMemory || diskManager.filesMap == nil {
+		diskManager.setSavePath(newSavePath)
+		return nil
+	}
+
+	err := os.MkdirAll(newSavePath, 0777)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", newSavePath, err)
+	}
+
+	diskManager.filesMap.mu.Lock()
+	defer diskManager.filesMap.mu.Unlock()
+
+	type move struct {
+		from, to string
+	}
+	var moves []move
+	// everything under the old save path goes to the same place under the
+	// new one
+	rebase := func(path string) (string, bool) {
+		relativePath, err := filepath.Rel(oldSavePath, path)
+		if err != nil || !insideDir(oldSavePath, path) {
+			return path, false
+		}
+		return filepath.Join(newSavePath, relativePath), true
+	}
+
+	newFiles := make([]fileData, len(diskManager.filesMap.filesData))
+	copy(newFiles, diskManager.filesMap.filesData)
+	for i := range newFiles {
+		fileData := &newFiles[i]
+		fileData.finalPath, _ = rebase(fileData.finalPath)
+
+		newPath, under := rebase(fileData.filePath)
+		if !under {
+			continue
+		}
+		if fileData.created {
+			moves = append(moves, move{from: fileData.filePath, to: newPath})
+		}
+		fileData.filePath = newPath
+	}
+
+	// Resume data is rewritten right after moving, the part file only
+	// exists once something of a skipped file came in
+	for _, path := range []string{diskManager.filesMap.partFilePath, diskManager.resumeFilePath()} {
+		if _, err := os.Stat(path); err == nil {
+			newPath, _ := rebase(path)
+			moves = append(moves, move{from: path, to: newPath})
+		}
+	}
+
+	// Renames would silently replace whatever is there
+	for _, m := range moves {
+		if _, err := os.Lstat(m.to); err == nil {
+			return fmt.Errorf("moving %s: %s already exists", m.from, m.to)
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("moving %s: %w", m.from, err)
+		}
+	}
+
+	diskManager.log().Info("moving files", "files", len(moves), "from", oldSavePath, "to", newSavePath)
+	for i, m := range moves {
+		err = os.MkdirAll(filepath.Dir(m.to), 0777)
+		if err == nil {
+			err = diskManager.relocate(m.from, m.to)
+		}
+		if err != nil {
+			// Put back what was moved so the old layout stays intact
+			for j := i - 1; j >= 0; j-- {
+				diskManager.relocate(moves[j].to, moves[j].from)
+			}
+			return fmt.Errorf("moving %s: %w", m.from, err)
+		}
+	}
+
+	for _, m := range moves {
+		removeEmptyDirs(filepath.Dir(m.from), oldSavePath)
+	}
+
+	diskManager.filesMap.filesData = newFiles
+	diskManager.filesMap.partFilePath, _ = rebase(diskManager.filesMap.partFilePath)
+	diskManager.setSavePath(newSavePath)
+	diskManager.log().Info("moved torrent data", "dir", newSavePath)
+	return nil
+}
+
+// removeEmptyDirs removes dir and its parents up to (not including) root
+// as long as they're empty
+func removeEmptyDirs(dir, root string) {
+	for insideDir(root, dir) && filepath.Clean(dir) != filepath.Clean(root) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Move moves the torrent's data to newSavePath without stopping it, see
+// DiskManager.Move. Resume data is saved at the new location right away.
+func (tm *TorrentManager) Move(newSavePath string) error {
+	err := tm.DiskManager.Move(newSavePath)
+	if err != nil {
+		return err
+	}
+	return tm.SaveResumeData()
+}
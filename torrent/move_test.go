@@ -0,0 +1,81 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMove(t *testing.T) {
+	tfi, content := newTestTorrent(t, "data", 16, []testFile{
+		{path: []string{"a.bin"}, length: 10},
+		{path: []string{"sub", "b.bin"}, length: 20},
+	}, "http://127.0.0.1:1/announce")
+
+	oldPath := t.TempDir()
+	diskManager := &DiskManager{TorrentFileInfo: &tfi, SavePath: oldPath}
+	err := diskManager.ScaffoldFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer diskManager.Close()
+
+	for piece := 0; piece*16 < len(content); piece++ {
+		_, err = diskManager.writeAt(piece, content[piece*16:min((piece+1)*16, len(content))], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Something already at the destination is left alone and nothing moves
+	taken := t.TempDir()
+	takenFile := filepath.Join(taken, "data", "a.bin")
+	os.MkdirAll(filepath.Dir(takenFile), 0777)
+	os.WriteFile(takenFile, []byte("keep"), 0666)
+
+	err = diskManager.Move(taken)
+	if err == nil {
+		t.Fatal("moving over an existing file worked")
+	}
+	if data, _ := os.ReadFile(takenFile); string(data) != "keep" {
+		t.Fatalf("existing file was overwritten: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(oldPath, "data", "sub", "b.bin")); err != nil {
+		t.Fatalf("data left the old save path: %v", err)
+	}
+	if diskManager.savePath() != oldPath {
+		t.Fatalf("save path changed to %s", diskManager.savePath())
+	}
+
+	// Save path is read while Move runs (resume data, Files)
+	newPath := t.TempDir()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 100 {
+			diskManager.resumeFilePath()
+		}
+	}()
+	err = diskManager.Move(newPath)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diskManager.savePath() != newPath {
+		t.Fatalf("save path is %s, want %s", diskManager.savePath(), newPath)
+	}
+
+	for piece := 0; piece*16 < len(content); piece++ {
+		data, err := diskManager.ReadPiece(piece)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, content[piece*16:min((piece+1)*16, len(content))]) {
+			t.Fatalf("piece %d changed while moving", piece)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(oldPath, "data")); !os.IsNotExist(err) {
+		t.Fatalf("old directory is still there: %v", err)
+	}
+}
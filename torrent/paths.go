@@ -0,0 +1,165 @@
+package torrent
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// A torrent is untrusted input. Its name and path components end up as
+// paths on our disk, so a malicious one could use "..", an absolute path
+// or a component with slashes in it to write outside the save path.
+// Everything goes through here before ScaffoldFiles touches the disk.
+
+type layoutFile struct {
+	path   string // relative to the save path, already sanitised
+	length int64
+}
+
+// layoutFiles returns the torrent's files in order with safe relative paths.
+// Multi-file torrents are nested in a directory named after the torrent.
+// name.utf-8 / path.utf-8 are preferred when present.
+func layoutFiles(info map[string]any, mode fileType) ([]layoutFile, error) {
+	name, err := sanitizeComponent(utf8Field(info, "name"))
+	if err != nil {
+		return nil, fmt.Errorf("torrent name: %w", err)
+	}
+
+	if mode == single {
+		length, ok := info["length"].(int64)
+		if !ok || length < 0 {
+			return nil, fmt.Errorf("file size has to be present")
+		}
+		return []layoutFile{{path: name, length: length}}, nil
+	}
+
+	files, ok := info["files"].([]any)
+	if !ok {
+		return nil, fmt.Errorf("files list not found in multi-file torrent")
+	}
+
+	var layout []layoutFile
+	seen := make(map[string]bool)
+	for i, file := range files {
+		f, ok := file.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("file %d: invalid entry", i)
+		}
+		length, ok := f["length"].(int64)
+		if !ok || length < 0 {
+			return nil, fmt.Errorf("file %d: length has to be a non-neg integer", i)
+		}
+
+		// Path is an array of path components
+		pathComponents, ok := f["path.utf-8"].([]any)
+		if !ok {
+			pathComponents, ok = f["path"].([]any)
+		}
+		if !ok || len(pathComponents) == 0 {
+			return nil, fmt.Errorf("file %d: path is missing", i)
+		}
+
+		pathParts := []string{name}
+		for _, component := range pathComponents {
+			part, ok := component.(string)
+			if !ok {
+				return nil, fmt.Errorf("file %d: path component is not a string", i)
+			}
+			part, err = sanitizeComponent(part)
+			if err != nil {
+				return nil, fmt.Errorf("file %d: %w", i, err)
+			}
+			pathParts = append(pathParts, part)
+		}
+
+		path := filepath.Join(pathParts...)
+		// Two files sanitised into one path would overwrite each other
+		if seen[path] {
+			return nil, fmt.Errorf("file %d: duplicate path %s", i, path)
+		}
+		seen[path] = true
+
+		layout = append(layout, layoutFile{path: path, length: length})
+	}
+	return layout, nil
+}
+
+// utf8Field returns key.utf-8 if the torrent has it, key otherwise
+func utf8Field(info map[string]any, key string) string {
+	if value, ok := info[key+".utf-8"].(string); ok {
+		return value
+	}
+	value, _ := info[key].(string)
+	return value
+}
+
+// Names Windows treats as devices, with or without an extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeComponent validates a single path component. Anything that can
+// escape the save path (traversal, separators, NUL) is rejected outright.
+// Things that are merely awkward are fixed up: invalid UTF-8 and control
+// characters become "_", reserved device names get a "_" prefix and
+// trailing dots/spaces (dropped silently by Windows) are trimmed.
+func sanitizeComponent(component string) (string, error) {
+	switch {
+	case component == "":
+		return "", fmt.Errorf("empty path component")
+	case component == "." || component == "..":
+		return "", fmt.Errorf("path traversal component %q", component)
+	case strings.ContainsRune(component, 0):
+		return "", fmt.Errorf("NUL byte in path component %q", component)
+	case strings.ContainsAny(component, `/\`):
+		return "", fmt.Errorf("separator inside path component %q", component)
+	case filepath.IsAbs(component) || filepath.VolumeName(component) != "" || hasDriveLetter(component):
+		return "", fmt.Errorf("absolute path component %q", component)
+	}
+
+	if !utf8.ValidString(component) {
+		component = strings.ToValidUTF8(component, "_")
+	}
+	component = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, component)
+
+	component = strings.TrimRight(component, ". ")
+	if component == "" {
+		return "", fmt.Errorf("path component is only dots and spaces")
+	}
+
+	base, _, _ := strings.Cut(component, ".")
+	if reservedNames[strings.ToUpper(base)] {
+		component = "_" + component
+	}
+	return component, nil
+}
+
+// hasDriveLetter spots "C:" style prefixes, VolumeName only does on
+// Windows and the files may be copied there later
+func hasDriveLetter(component string) bool {
+	if len(component) < 2 || component[1] != ':' {
+		return false
+	}
+	letter := component[0] | 0x20
+	return letter >= 'a' && letter <= 'z'
+}
+
+// insideDir makes sure path resolves to somewhere under dir. Last line of
+// defence in case sanitising missed something.
+func insideDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
@@ -0,0 +1,250 @@
+package torrent
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSanitizeComponent(t *testing.T) {
+	tests := []struct {
+		component string
+		want      string
+		wantErr   bool
+	}{
+		{component: "file.bin", want: "file.bin"},
+		{component: "", wantErr: true},
+		{component: ".", wantErr: true},
+		{component: "..", wantErr: true},
+		{component: "/etc", wantErr: true},
+		{component: "a/b", wantErr: true},
+		{component: `a\b`, wantErr: true},
+		{component: `C:\Windows`, wantErr: true},
+		{component: "C:evil", wantErr: true},
+		{component: "d:", wantErr: true},
+		{component: "a\x00b", wantErr: true},
+		{component: "...", wantErr: true},
+		{component: ". .", wantErr: true},
+		{component: "tab\there", want: "tab_here"},
+		{component: "bad\xffutf8", want: "bad_utf8"},
+		{component: "trailing. .", want: "trailing"},
+		{component: "CON", want: "_CON"},
+		{component: "nul.txt", want: "_nul.txt"},
+		{component: "com1.tar.gz", want: "_com1.tar.gz"},
+		{component: "console", want: "console"},
+		{component: "LPT10", want: "LPT10"},
+	}
+
+	for _, test := range tests {
+		got, err := sanitizeComponent(test.component)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("sanitizeComponent(%q) = %q, want an error", test.component, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("sanitizeComponent(%q): %v", test.component, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("sanitizeComponent(%q) = %q, want %q", test.component, got, test.want)
+		}
+	}
+}
+
+// testInfoFile is one entry of a files list, path.utf-8 left out when nil
+func testInfoFile(length int64, path []any, utf8Path []any) map[string]any {
+	file := map[string]any{"length": length, "path": path}
+	if utf8Path != nil {
+		file["path.utf-8"] = utf8Path
+	}
+	return file
+}
+
+func TestLayoutFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		info    map[string]any
+		mode    fileType
+		want    []layoutFile
+		wantErr bool
+	}{
+		{
+			name: "single file",
+			info: map[string]any{"name": "file.bin", "length": int64(10)},
+			mode: single,
+			want: []layoutFile{{path: "file.bin", length: 10}},
+		},
+		{
+			name: "single file name.utf-8 preferred",
+			info: map[string]any{"name": "f\xe9", "name.utf-8": "fé", "length": int64(10)},
+			mode: single,
+			want: []layoutFile{{path: "fé", length: 10}},
+		},
+		{
+			name:    "single file traversal name",
+			info:    map[string]any{"name": "..", "length": int64(10)},
+			mode:    single,
+			wantErr: true,
+		},
+		{
+			name:    "single file absolute name",
+			info:    map[string]any{"name": "/etc/passwd", "length": int64(10)},
+			mode:    single,
+			wantErr: true,
+		},
+		{
+			name: "single file reserved name",
+			info: map[string]any{"name": "aux.bin", "length": int64(10)},
+			mode: single,
+			want: []layoutFile{{path: "_aux.bin", length: 10}},
+		},
+		{
+			name: "nested under the torrent name",
+			info: map[string]any{"name": "data", "files": []any{
+				testInfoFile(1, []any{"a.bin"}, nil),
+				testInfoFile(2, []any{"sub", "b.bin"}, nil),
+			}},
+			mode: multi,
+			want: []layoutFile{
+				{path: filepath.Join("data", "a.bin"), length: 1},
+				{path: filepath.Join("data", "sub", "b.bin"), length: 2},
+			},
+		},
+		{
+			name: "path.utf-8 preferred over path",
+			info: map[string]any{"name": "data", "files": []any{
+				testInfoFile(1, []any{"caf\xe9"}, []any{"café"}),
+			}},
+			mode: multi,
+			want: []layoutFile{{path: filepath.Join("data", "café"), length: 1}},
+		},
+		{
+			name: "traversal component",
+			info: map[string]any{"name": "data", "files": []any{
+				testInfoFile(1, []any{"..", "..", "evil"}, nil),
+			}},
+			mode:    multi,
+			wantErr: true,
+		},
+		{
+			name: "traversal only in path.utf-8",
+			info: map[string]any{"name": "data", "files": []any{
+				testInfoFile(1, []any{"fine"}, []any{"..", "evil"}),
+			}},
+			mode:    multi,
+			wantErr: true,
+		},
+		{
+			name: "absolute component",
+			info: map[string]any{"name": "data", "files": []any{
+				testInfoFile(1, []any{"/etc", "passwd"}, nil),
+			}},
+			mode:    multi,
+			wantErr: true,
+		},
+		{
+			name: "drive component",
+			info: map[string]any{"name": "data", "files": []any{
+				testInfoFile(1, []any{`C:\Windows`, "evil.dll"}, nil),
+			}},
+			mode:    multi,
+			wantErr: true,
+		},
+		{
+			name: "separator inside a component",
+			info: map[string]any{"name": "data", "files": []any{
+				testInfoFile(1, []any{"../evil"}, nil),
+			}},
+			mode:    multi,
+			wantErr: true,
+		},
+		{
+			name: "NUL inside a component",
+			info: map[string]any{"name": "data", "files": []any{
+				testInfoFile(1, []any{"evil\x00.txt"}, nil),
+			}},
+			mode:    multi,
+			wantErr: true,
+		},
+		{
+			name: "reserved component",
+			info: map[string]any{"name": "data", "files": []any{
+				testInfoFile(1, []any{"PRN", "lpt1.txt"}, nil),
+			}},
+			mode: multi,
+			want: []layoutFile{{path: filepath.Join("data", "_PRN", "_lpt1.txt"), length: 1}},
+		},
+		{
+			name: "duplicate after sanitising",
+			info: map[string]any{"name": "data", "files": []any{
+				testInfoFile(1, []any{"a.txt"}, nil),
+				testInfoFile(2, []any{"a.txt. "}, nil),
+			}},
+			mode:    multi,
+			wantErr: true,
+		},
+		{
+			name: "duplicate paths",
+			info: map[string]any{"name": "data", "files": []any{
+				testInfoFile(1, []any{"sub", "a.txt"}, nil),
+				testInfoFile(2, []any{"sub", "a.txt"}, nil),
+			}},
+			mode:    multi,
+			wantErr: true,
+		},
+		{
+			name: "empty path",
+			info: map[string]any{"name": "data", "files": []any{
+				testInfoFile(1, []any{}, nil),
+			}},
+			mode:    multi,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layout, err := layoutFiles(test.info, test.mode)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got layout %v", layout)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(layout) != len(test.want) {
+				t.Fatalf("got layout %v, want %v", layout, test.want)
+			}
+			for i := range layout {
+				if layout[i] != test.want[i] {
+					t.Fatalf("got layout %v, want %v", layout, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestInsideDir(t *testing.T) {
+	dir := filepath.Join("save", "path")
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{filepath.Join(dir, "data", "a.bin"), true},
+		{filepath.Join(dir, "..dots"), true},
+		{dir, true},
+		{filepath.Join(dir, ".."), false},
+		{filepath.Join(dir, "..", "other"), false},
+		{filepath.Join(dir, "data", "..", "..", "..", "evil"), false},
+		{filepath.Join("save", "pathological"), false},
+	}
+
+	for _, test := range tests {
+		if got := insideDir(dir, test.path); got != test.want {
+			t.Errorf("insideDir(%q, %q) = %v, want %v", dir, test.path, got, test.want)
+		}
+	}
+}
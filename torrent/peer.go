@@ -1,10 +1,14 @@
 package torrent
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"sync"
+	"time"
 )
 
 type Peer struct {
@@ -13,14 +17,30 @@ type Peer struct {
 	port                    uint
 	infoHash                string
 	am_interested           bool
-	unchoked                bool
-	bitfield                []byte
-	Status                  string // (idle/inactive/active)
 	mu                      sync.Mutex
 	PeerId                  string
 	conn                    net.Conn
-	BlockRequestResponseBus *BlockRequestResponseBus
+	blockRequestResponseBus *blockRequestResponseBus
+	idlePeerBus             *idlePeerBus       // set by PeerManager.InsertPeer
+	droppedRequestBus       *droppedRequestBus // set by PeerManager.InsertPeer
+	Availability            *Availability
 	TotalPieces             uint // Total pieces in torrent (for bitfield initialization)
+	downloadLimiter         *RateLimiter
+	logger                  *slog.Logger // set by PeerManager.InsertPeer
+	requestedAt             time.Time
+	downloadRate            float64 // bytes/sec, moving average over received blocks
+	statsMu                 sync.Mutex
+
+	// Written by the Listen go routine and read by the event loop, under
+	// stateMu
+	unchoked bool
+	bitfield []byte
+	status   string // connecting/idle/active/inactive
+	// the block we're waiting for while active
+	requested *Block
+	// on the idle peer bus, or taken off it but not looked at yet
+	queued  bool
+	stateMu sync.Mutex
 }
 
 // From unofficial docs <https://wiki.theory.org/BitTorrentSpecification:
@@ -28,7 +48,7 @@ type Peer struct {
 // by the client. It is (49+len(pstr)) bytes long.
 // handshake: <pstrlen><pstr><reserved><info_hash><peer_id>
 
-func (p *Peer) Handshake() error {
+func (p *Peer) handshakeMessage() []byte {
 	payload := make([]byte, 68)
 	pstrlen := byte(uint8(19))
 	payload[0] = pstrlen
@@ -38,15 +58,38 @@ func (p *Peer) Handshake() error {
 	binary.BigEndian.PutUint64(payload[20:28], 0)
 	copy(payload[28:48], []byte(p.infoHash))
 	copy(payload[48:68], []byte(p.PeerId))
+	return payload
+}
+
+// log is the peer's logger, nothing is logged before InsertPeer sets it
+func (p *Peer) log() *slog.Logger {
+	return loggerOr(p.logger)
+}
 
-	ipAddress := net.JoinHostPort(p.Ip, fmt.Sprintf("%d", p.port))
-	conn, err := net.Dial("tcp", ipAddress)
+// Addr is the peer's host:port
+func (p *Peer) Addr() string {
+	return net.JoinHostPort(p.Ip, fmt.Sprintf("%d", p.port))
+}
+
+func (p *Peer) Handshake(ctx context.Context) error {
+	payload := p.handshakeMessage()
+
+	ipAddress := p.Addr()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", ipAddress)
 	if err != nil {
 		return fmt.Errorf("Failed to connect with Peer")
 	}
 
 	p.conn = conn
 
+	// Listen closes the connection once ctx is done, until then a peer
+	// that never answers would keep us (and Pause/Stop) waiting here
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
 	_, err = conn.Write(payload)
 	if err != nil {
 		return fmt.Errorf("Failed to write to Peer")
@@ -54,7 +97,7 @@ func (p *Peer) Handshake() error {
 
 	// Read the peer's handshake response (68 bytes)
 	response := make([]byte, 68)
-	_, err = conn.Read(response)
+	_, err = io.ReadFull(conn, response)
 	if err != nil {
 		return fmt.Errorf("Failed to read handshake response: %v", err)
 	}
@@ -64,7 +107,7 @@ func (p *Peer) Handshake() error {
 		return fmt.Errorf("Invalid handshake response")
 	}
 
-	fmt.Printf(" Handshake successful with peer %s\n", p.Ip)
+	p.log().Debug("handshake successful")
 
 	// Send interested message to peer
 	err = p.sendInterested()
@@ -72,8 +115,25 @@ func (p *Peer) Handshake() error {
 		return fmt.Errorf("Failed to send interested message: %v", err)
 	}
 
-	fmt.Printf(" Sent 'interested' message to peer %s\n", p.Ip)
+	p.log().Debug("sent interested")
+
+	return nil
+}
+
+// acceptHandshake answers a peer that connected to us. Its handshake was
+// already read to find out which torrent it wants.
+func (p *Peer) acceptHandshake(conn net.Conn) error {
+	p.conn = conn
+
+	_, err := conn.Write(p.handshakeMessage())
+	if err != nil {
+		return fmt.Errorf("Failed to write to Peer")
+	}
 
+	err = p.sendInterested()
+	if err != nil {
+		return fmt.Errorf("Failed to send interested message: %v", err)
+	}
 	return nil
 }
 
@@ -108,15 +168,24 @@ func (p *Peer) sendInterested() error {
 //
 // <length prefix><message ID><payload>
 
-func (p *Peer) Listen() {
+// Listen reads messages until the connection drops, returning why, or ctx
+// is done (which closes the connection), returning nil
+func (p *Peer) Listen(ctx context.Context) error {
 	conn := p.conn
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
 	for {
 		// Read message length prefix (4 bytes)
 		lengthBuf := make([]byte, 4)
 		_, err := conn.Read(lengthBuf)
 		if err != nil {
-			fmt.Printf("Peer %s disconnected: %v\n", p.Ip, err)
-			return // Exit the goroutine on error
+			p.disconnected(ctx)
+			if ctx.Err() != nil {
+				return nil
+			}
+			p.log().Debug("peer disconnected", "err", err)
+			return err // Exit the goroutine on error
 		}
 
 		messageLength := binary.BigEndian.Uint32(lengthBuf)
@@ -130,8 +199,12 @@ func (p *Peer) Listen() {
 		messageIDBuf := make([]byte, 1)
 		_, err = conn.Read(messageIDBuf)
 		if err != nil {
-			fmt.Printf("Failed to read message ID from %s: %v\n", p.Ip, err)
-			return
+			p.disconnected(ctx)
+			if ctx.Err() != nil {
+				return nil
+			}
+			p.log().Debug("failed to read message ID", "err", err)
+			return err
 		}
 		messageID := messageIDBuf[0]
 
@@ -144,64 +217,243 @@ func (p *Peer) Listen() {
 			for bytesRead < int(payloadLength) {
 				n, err := conn.Read(payload[bytesRead:])
 				if err != nil {
-					fmt.Printf("Failed to read payload from %s: %v\n", p.Ip, err)
-					return
+					p.disconnected(ctx)
+					if ctx.Err() != nil {
+						return nil
+					}
+					p.log().Debug("failed to read payload", "err", err)
+					return err
 				}
 				bytesRead += n
 			}
 		}
 
+		// Slow down reading blocks when over the download limit, the peer
+		// notices through TCP
+		if messageID == 7 {
+			p.downloadLimiter.Wait(ctx, len(payload))
+		}
+
 		// Handle different message types
 		switch messageID {
 		case 0: // Peer choked me
-			fmt.Printf(" Peer %s choked us\n", p.Ip)
-			p.peerChokedMe()
+			p.log().Debug("peer choked us")
+			p.peerChokedMe(ctx)
 		case 1: // peer unchoked me
-			fmt.Printf(" Peer %s unchoked us - ready to download!\n", p.Ip)
+			p.log().Debug("peer unchoked us")
 			p.peerUnchokedMe()
+		case 4: // peer got a new piece
+			p.peerSentMeHave(payload)
 		case 5: // peer sent bitfield
-			fmt.Printf(" Received bitfield from peer %s (%d bytes)\n", p.Ip, len(payload))
-			p.peerSentMeBitfield(payload)
-			fmt.Printf(" DEBUG: Bitfield stored, length=%d, unchoked=%v\n", len(p.bitfield), p.unchoked)
+			p.log().Debug("received bitfield", "bytes", len(payload))
+			err = p.peerSentMeBitfield(payload)
+			if err != nil {
+				p.disconnected(ctx)
+				p.log().Debug("dropping peer", "err", err)
+				return err
+			}
 		case 7: // Peer sent a piece(actually a block)
-			fmt.Printf(" Received block data from peer %s (%d bytes)\n", p.Ip, len(payload))
-			p.peerSentMeABlock(payload)
+			p.peerSentMeABlock(ctx, payload)
 		default:
 			// Ignore unknown message types
-			fmt.Printf(" Unknown message type %d from peer %s\n", messageID, p.Ip)
+			p.log().Debug("ignoring unknown message", "id", messageID)
 		}
 	}
 }
 
-func (p *Peer) peerChokedMe() {
+// A choke drops whatever we had asked (BEP 3), the block has to go to
+// another peer
+func (p *Peer) peerChokedMe(ctx context.Context) {
+	p.stateMu.Lock()
 	p.unchoked = false
+	dropped := p.requested != nil
+	p.requested = nil
+	if p.status == "active" {
+		p.status = "idle"
+	}
+	p.stateMu.Unlock()
+
+	if dropped {
+		p.requestsDropped(ctx)
+	}
 }
 
 func (p *Peer) peerUnchokedMe() {
+	p.stateMu.Lock()
 	p.unchoked = true
-	// Set to idle when unchoked (bitfield might have been sent earlier, or peer uses "have" messages)
-	p.Status = "idle"
-	if p.bitfield != nil && len(p.bitfield) > 0 {
-		fmt.Printf(" Peer %s is now ready (has bitfield + unchoked)\n", p.Ip)
-	} else {
-		fmt.Printf(" Peer %s is now ready (unchoked, no bitfield yet - will use 'have' messages)\n", p.Ip)
+	// Set to idle when unchoked (bitfield might have been sent earlier, or
+	// peer uses "have" messages). An unchoke we didn't need leaves an
+	// outstanding request alone.
+	if p.status != "inactive" && p.requested == nil {
+		p.status = "idle"
 	}
+	p.stateMu.Unlock()
+
+	p.log().Debug("peer is ready", "has_bitfield", len(p.bitfield) > 0)
+	p.ready()
 }
 
-func (p *Peer) peerSentMeBitfield(payload []byte) {
+// bitfield: <len=0001+X><id=5><bitfield>, X is one bit per piece rounded
+// up to whole bytes. Anything else gets the peer dropped, a short one
+// would have later haves index past its end.
+func (p *Peer) peerSentMeBitfield(payload []byte) error {
+	expected := int(p.TotalPieces+7) / 8
+	if len(payload) != expected {
+		return fmt.Errorf("bitfield has %d bytes, expected %d", len(payload), expected)
+	}
+
+	// A have could have arrived first, swap its counts for the full bitfield
+	p.Availability.RemoveBitfield(p.bitfield)
+	p.stateMu.Lock()
 	p.bitfield = payload
-	// Set to idle if already unchoked
-	if p.unchoked {
-		p.Status = "idle"
-		fmt.Printf(" Peer %s is now ready (has bitfield + unchoked)\n", p.Ip)
+	p.stateMu.Unlock()
+	p.Availability.AddBitfield(payload)
+
+	// Picks up the new pieces if it's unchoked and not busy
+	p.ready()
+	return nil
+}
+
+// have: <len=0005><id=4><piece index>
+func (p *Peer) peerSentMeHave(payload []byte) {
+	if len(payload) < 4 {
+		p.log().Debug("invalid have message", "bytes", len(payload))
+		return
+	}
+	index := int(binary.BigEndian.Uint32(payload[0:4]))
+	if index >= int(p.TotalPieces) || p.hasPiece(index) {
+		return
+	}
+
+	p.stateMu.Lock()
+	// Peers that start empty (or use lazy bitfields) never send one
+	if len(p.bitfield) <= index/8 {
+		bitfield := make([]byte, (p.TotalPieces+7)/8)
+		copy(bitfield, p.bitfield)
+		p.bitfield = bitfield
+	}
+	p.bitfield[index/8] |= 1 << (7 - uint(index%8))
+	p.stateMu.Unlock()
+	p.Availability.AddPiece(index)
+
+	p.ready()
+}
+
+// disconnected takes the peer out of rotation and stops counting its
+// pieces. Its request goes to another peer.
+func (p *Peer) disconnected(ctx context.Context) {
+	p.stateMu.Lock()
+	p.status = "inactive"
+	bitfield := p.bitfield
+	p.bitfield = nil
+	dropped := p.requested != nil
+	p.requested = nil
+	p.stateMu.Unlock()
+
+	p.Availability.RemoveBitfield(bitfield)
+	if dropped {
+		p.requestsDropped(ctx)
+	}
+}
+
+// requestsDropped tells the event loop the block we asked for won't come.
+// Nobody is left to tell once ctx is done, stopDownload puts it back.
+func (p *Peer) requestsDropped(ctx context.Context) {
+	if p.droppedRequestBus == nil {
+		return
+	}
+	select {
+	case p.droppedRequestBus.peers <- p:
+	case <-ctx.Done():
+	}
+}
+
+// Status is connecting, idle (can take a request), active (waiting for the
+// block it was asked) or inactive (disconnected)
+func (p *Peer) Status() string {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+
+	return p.status
+}
+
+func (p *Peer) setStatus(status string) {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+
+	p.status = status
+}
+
+// ready puts the peer on the idle peer bus if it can take a request:
+// unchoked and idle (or still connecting). It's called whenever something
+// may have given the peer work. A busy peer is asked again once its block
+// arrives.
+func (p *Peer) ready() {
+	p.stateMu.Lock()
+	queue := p.unchoked && !p.queued && p.idlePeerBus != nil &&
+		(p.status == "idle" || p.status == "connecting")
+	if queue {
+		p.status = "idle"
+		p.queued = true
+	}
+	p.stateMu.Unlock()
+
+	if queue {
+		p.idlePeerBus.push(p)
+	}
+}
+
+// requestDone frees the peer's request slot, its block arrived or the
+// request was cancelled, and queues it for the next one. Late blocks of
+// requests we cancelled or that a choke dropped don't match the one
+// outstanding and leave the slot alone.
+func (p *Peer) requestDone(pieceIndex, blockIndex uint) {
+	p.stateMu.Lock()
+	done := p.requested != nil &&
+		p.requested.pieceIndex == pieceIndex && p.requested.blockIndex == blockIndex
+	if done {
+		p.requested = nil
+		if p.status == "active" {
+			p.status = "idle"
+		}
+	}
+	p.stateMu.Unlock()
+
+	if done {
+		p.ready()
+	}
+}
+
+// dequeued is called by the event loop for a peer it got from the idle
+// peer bus. False means the peer can't take a request any more
+// (disconnected, choked or busy since it was queued).
+func (p *Peer) dequeued() bool {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+
+	p.queued = false
+	return p.status == "idle" && p.unchoked
+}
+
+// activate marks an idle peer as waiting for a block, false when it isn't
+// idle (or unchoked) any more
+func (p *Peer) activate(block *Block) bool {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+
+	if p.status != "idle" || !p.unchoked {
+		return false
 	}
+	p.status = "active"
+	p.requested = block
+	return true
 }
 
 // piece: <len=0009+X><id=7><index><begin><block>
 // Payload format: 4 bytes piece index + 4 bytes begin offset + block data
-func (p *Peer) peerSentMeABlock(payload []byte) {
+func (p *Peer) peerSentMeABlock(ctx context.Context, payload []byte) {
 	if len(payload) < 8 {
-		fmt.Printf(" Invalid block payload size: %d bytes\n", len(payload))
+		p.log().Debug("invalid piece message", "bytes", len(payload))
 		return
 	}
 
@@ -217,52 +469,142 @@ func (p *Peer) peerSentMeABlock(payload []byte) {
 	// Extract block data (remaining bytes)
 	blockData := payload[8:]
 
-	fmt.Printf(" Parsed block: piece=%d, begin=%d, blockIndex=%d, dataSize=%d\n",
-		pieceIndex, begin, blockIndex, len(blockData))
+	p.log().Debug("received block",
+		"piece", pieceIndex, "begin", begin, "block", blockIndex, "bytes", len(blockData))
 
-	blockResponse := &BlockResponse{
+	response := &blockResponse{
+		peer:       p,
 		pieceIndex: uint(pieceIndex),
 		blockIndex: uint(blockIndex),
 		blockData:  blockData,
 	}
 
-	// Set peer back to idle after receiving block
-	p.Status = "idle"
+	p.recordDownload(len(blockData))
 
-	p.BlockRequestResponseBus.BlockResponse <- blockResponse
+	// Set peer back to idle after receiving block, it gets asked for the
+	// next one right away
+	p.requestDone(uint(pieceIndex), uint(blockIndex))
+
+	// Nobody takes blocks any more once we're stopping
+	select {
+	case p.blockRequestResponseBus.responses <- response:
+	case <-ctx.Done():
+	}
 }
 
 // request: <len=0013><id=6><index><begin><length>
 // Message format: 4 bytes length prefix + 1 byte message ID + 4 bytes piece index + 4 bytes begin offset + 4 bytes block length
-func (p *Peer) DownloadBlock(blockRequest *BlockRequest) error {
-	block := blockRequest.block
+func (p *Peer) DownloadBlock(request *blockRequest) error {
+	block := request.block
+
+	p.log().Debug("sending request", "piece", block.pieceIndex, "begin", block.offset, "length", block.length)
+
+	p.statsMu.Lock()
+	p.requestedAt = time.Now()
+	p.statsMu.Unlock()
+
+	return p.writeMessage(blockMessage(6, block))
+}
+
+// recordDownload updates the download rate with a block that just arrived.
+// We only have one request in flight per peer, so time since the request
+// went out is a fair measure of how fast this peer is.
+func (p *Peer) recordDownload(size int) {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+
+	if p.requestedAt.IsZero() {
+		return
+	}
+	elapsed := time.Since(p.requestedAt).Seconds()
+	p.requestedAt = time.Time{}
+	if elapsed <= 0 {
+		return
+	}
+
+	rate := float64(size) / elapsed
+	if p.downloadRate == 0 {
+		p.downloadRate = rate
+		return
+	}
+	p.downloadRate = 0.8*p.downloadRate + 0.2*rate
+}
+
+// DownloadRate returns bytes/sec we have been getting from the peer
+func (p *Peer) DownloadRate() float64 {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
 
-	// Calculate the byte offset within the piece
-	begin := uint32(block.blockIndex) * uint32(blockLength)
+	return p.downloadRate
+}
+
+// cancel: <len=0013><id=8><index><begin><length>
+// Same layout as request. Used in endgame when another peer already
+// delivered the block we asked this peer for.
+func (p *Peer) CancelBlock(block *Block) error {
+	p.log().Debug("sending cancel", "piece", block.pieceIndex, "begin", block.offset, "length", block.length)
+
+	return p.writeMessage(blockMessage(8, block))
+}
 
-	// Create message: length prefix (4) + message ID (1) + index (4) + begin (4) + length (4) = 17 bytes
+// blockMessage builds a request(6) or cancel(8) message for a block
+// Create message: length prefix (4) + message ID (1) + index (4) + begin (4) + length (4) = 17 bytes
+func blockMessage(messageID byte, block *Block) []byte {
 	message := make([]byte, 17)
 
 	// Length prefix (13 bytes for the message after the length prefix)
 	binary.BigEndian.PutUint32(message[0:4], 13)
+	message[4] = messageID
 
-	// Message ID (6 = request)
-	message[4] = 6
-
-	// Piece index (4 bytes)
+	// Piece index, begin offset within the piece and block length (4 bytes each)
 	binary.BigEndian.PutUint32(message[5:9], uint32(block.pieceIndex))
+	binary.BigEndian.PutUint32(message[9:13], uint32(block.offset))
+	binary.BigEndian.PutUint32(message[13:17], uint32(block.length))
 
-	// Begin offset (4 bytes)
-	binary.BigEndian.PutUint32(message[9:13], begin)
-
-	// Block length (4 bytes)
-	binary.BigEndian.PutUint32(message[13:17], uint32(blockLength))
+	return message
+}
 
-	fmt.Printf(" Sending request: piece=%d, begin=%d, length=%d\n", block.pieceIndex, begin, blockLength)
+// writeMessage serialises writes to the connection. Requests are sent from
+// peer manager go routines while cancels come from the torrent manager.
+func (p *Peer) writeMessage(message []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
 	_, err := p.conn.Write(message)
-	if err != nil {
-		return err
+	return err
+}
+
+// hasPiece checks the peer's bitfield for a piece
+func (p *Peer) hasPiece(index int) bool {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+
+	return bitfieldHas(p.bitfield, index)
+}
+
+// bitfieldCopy is the peer's bitfield as of now, nil before it sent any
+func (p *Peer) bitfieldCopy() []byte {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+
+	if p.bitfield == nil {
+		return nil
 	}
-	return nil
+	bitfield := make([]byte, len(p.bitfield))
+	copy(bitfield, p.bitfield)
+	return bitfield
+}
+
+// bitfieldHas checks a bitfield for a piece
+// Bitfield is a byte array where each bit represents a piece
+func bitfieldHas(bitfield []byte, index int) bool {
+	byteIndex := index / 8
+	bitIndex := uint(index % 8)
+
+	// Check if we have enough bytes in bitfield
+	if byteIndex >= len(bitfield) {
+		return false
+	}
+
+	return (bitfield[byteIndex] & (1 << (7 - bitIndex))) != 0
 }
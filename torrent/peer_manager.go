@@ -1,24 +1,74 @@
 package torrent
 
 import (
-	"fmt"
+	"context"
+	"log/slog"
+	"sort"
 	"sync"
-	"time"
 )
 
-type IdlePeerBus struct {
-	Peer chan *Peer
+// idlePeerBus carries peers that can take a request to the event loop.
+// Peers put themselves on it when something may have given them work
+// (unchoke, bitfield or have, a block arriving, a request cancelled), a
+// peer is on it at most once (see Peer.queued). FindIdlePeers moves them
+// from the queue to the channel.
+type idlePeerBus struct {
+	peers chan *Peer
+	queue []*Peer
+	// signalled when the queue gets a peer
+	wake chan struct{}
+	mu   sync.Mutex
 }
 
-// I think channel can be directly ref(IdlePeerBus) here.
+func newIdlePeerBus() *idlePeerBus {
+	return &idlePeerBus{
+		peers: make(chan *Peer),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// push queues a peer and wakes FindIdlePeers
+func (bus *idlePeerBus) push(p *Peer) {
+	bus.mu.Lock()
+	bus.queue = append(bus.queue, p)
+	bus.mu.Unlock()
+
+	select {
+	case bus.wake <- struct{}{}:
+	default: // already signalled
+	}
+}
+
+// take empties the queue
+func (bus *idlePeerBus) take() []*Peer {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	peers := bus.queue
+	bus.queue = nil
+	return peers
+}
+
+// I think channel can be directly ref(idlePeerBus) here.
 // No need of decoupling this. Feels unnecessary
 type PeerManager struct {
 	Peers                   []*Peer
 	Infohash                string
-	IdlePeerBus             *IdlePeerBus
-	BlockRequestBus         *BlockRequestBus
-	BlockRequestResponseBus *BlockRequestResponseBus
-	mu                      sync.Mutex
+	idlePeerBus             *idlePeerBus
+	blockRequestBus         *blockRequestBus
+	blockRequestResponseBus *blockRequestResponseBus
+	droppedRequestBus       *droppedRequestBus
+	Availability            *Availability
+	// Shared by every peer of every torrent of a client, optional
+	DownloadLimiter *RateLimiter
+	// Peers log through it with their address added, nothing is logged
+	// when nil
+	Logger *slog.Logger
+	mu     sync.Mutex
+}
+
+func (peerManager *PeerManager) log() *slog.Logger {
+	return loggerOr(peerManager.Logger)
 }
 
 func (peerManager *PeerManager) PeerExists(ip string, port uint) bool {
@@ -36,55 +86,133 @@ func (peerManager *PeerManager) InsertPeer(p *Peer) {
 	peerManager.mu.Lock()
 	defer peerManager.mu.Unlock()
 
-	p.BlockRequestResponseBus = peerManager.BlockRequestResponseBus
+	p.blockRequestResponseBus = peerManager.blockRequestResponseBus
+	p.Availability = peerManager.Availability
+	p.downloadLimiter = peerManager.DownloadLimiter
+	p.idlePeerBus = peerManager.idlePeerBus
+	p.droppedRequestBus = peerManager.droppedRequestBus
+	p.logger = peerManager.log().With("peer", p.Addr())
 
 	peerManager.Peers = append(peerManager.Peers, p)
 }
 
+// FastestPeers returns up to n peers we've downloaded from, fastest first
+func (peerManager *PeerManager) FastestPeers(n int) []*Peer {
+	peerManager.mu.Lock()
+	var peers []*Peer
+	for _, peer := range peerManager.Peers {
+		if peer.DownloadRate() > 0 {
+			peers = append(peers, peer)
+		}
+	}
+	peerManager.mu.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].DownloadRate() > peers[j].DownloadRate()
+	})
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+// PeerCount is how many peers we know of, connected or not
+func (peerManager *PeerManager) PeerCount() int {
+	peerManager.mu.Lock()
+	defer peerManager.mu.Unlock()
+
+	return len(peerManager.Peers)
+}
+
+// FindIdlePeers hands peers that put themselves on the idle peer bus to
+// the event loop as soon as they do, until ctx is done.
 // will run in a go routine
-// will be touched only by a single routine
-// so no lock needed
-func (peerManager *PeerManager) FindIdlePeers() {
-	fmt.Println(" Starting idle peer finder...")
+func (peerManager *PeerManager) FindIdlePeers(ctx context.Context) {
+	peerManager.log().Debug("starting idle peer finder")
+	bus := peerManager.idlePeerBus
+
 	for {
-		idleCount := 0
-		for _, peer := range peerManager.Peers {
-			if peer.Status == "idle" {
-				peerManager.IdlePeerBus.Peer <- peer
-				idleCount++
-			}
+		select {
+		case <-bus.wake:
+		case <-ctx.Done():
+			return
 		}
-		if idleCount > 0 {
-			fmt.Printf(" Found %d idle peer(s), sending to bus\n", idleCount)
+
+		peers := bus.take()
+		if len(peers) == 0 {
+			continue
+		}
+		peerManager.log().Debug("found idle peers, sending them to the bus", "count", len(peers))
+		for _, peer := range peers {
+			select {
+			case bus.peers <- peer:
+			case <-ctx.Done():
+				return
+			}
 		}
-		time.Sleep(500 * time.Millisecond)
 	}
 }
 
-func (peerManager *PeerManager) ReadBlockRequestBus() {
-	fmt.Println(" Starting block request bus reader...")
+// wakeIdlePeers puts every idle peer back on the idle peer bus. It's for
+// when work shows up that isn't tied to a peer: a piece to download again,
+// a file or a reader wanting more pieces, endgame starting.
+func (peerManager *PeerManager) wakeIdlePeers() {
+	peerManager.mu.Lock()
+	peers := make([]*Peer, len(peerManager.Peers))
+	copy(peers, peerManager.Peers)
+	peerManager.mu.Unlock()
+
+	for _, peer := range peers {
+		peer.ready()
+	}
+}
+
+func (peerManager *PeerManager) ReadBlockRequestBus(ctx context.Context) {
+	peerManager.log().Debug("starting block request bus reader")
+	var requests sync.WaitGroup
+	defer requests.Wait()
+
 	for {
-		blockRequest := <-peerManager.BlockRequestBus.BlockRequest
-		fmt.Printf(" Processing block request (piece=%d, block=%d) for peer %s\n",
-			blockRequest.block.pieceIndex, blockRequest.block.blockIndex, blockRequest.peer.Ip)
-		go peerManager.DownloadBlock(blockRequest)
+		var request *blockRequest
+		select {
+		case request = <-peerManager.blockRequestBus.requests:
+		case <-ctx.Done():
+			return
+		}
+		peerManager.log().Debug("processing block request",
+			"piece", request.block.pieceIndex, "block", request.block.blockIndex, "peer", request.peer.Addr())
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			peerManager.DownloadBlock(request)
+		}()
 	}
 }
 
+// RemoveAllPeers forgets every peer so the next tracker announce connects
+// to them again. Connections are closed by cancelling the context their
+// Listen runs with.
+func (peerManager *PeerManager) RemoveAllPeers() {
+	peerManager.mu.Lock()
+	defer peerManager.mu.Unlock()
+
+	peerManager.Peers = nil
+	// Whoever is still queued is disconnected
+	peerManager.idlePeerBus.take()
+}
+
 // Should this go inside peer instead of peerManager?
 // The problem is that peer doesn't have ref to PeerManager
-// which has BlockRequestResponseBus. So how will it respond back
+// which has blockRequestResponseBus. So how will it respond back
 // there?
-func (PeerManager *PeerManager) DownloadBlock(blockrequest *BlockRequest) {
-	peer := blockrequest.peer
-
-	// Mark peer as active while downloading
-	peer.Status = "active"
+func (PeerManager *PeerManager) DownloadBlock(request *blockRequest) {
+	peer := request.peer
 
-	err := peer.DownloadBlock(blockrequest)
+	// The event loop marked the peer active when it picked the block
+	err := peer.DownloadBlock(request)
 	if err != nil {
-		fmt.Printf(" Failed to send block request: %v\n", err)
-		// Set back to idle on error so it can be retried
-		peer.Status = "idle"
+		// The connection is gone, Listen marks the peer inactive and hands
+		// the block to another peer
+		peer.log().Debug("failed to send block request", "err", err)
 	}
 }
@@ -3,16 +3,48 @@ package torrent
 import (
 	"fmt"
 	"sync"
+	"time"
 )
 
 const blockLength = 16 * 1024
 
+// Priority decides how eagerly a piece is downloaded by the priority picker.
+// PrioritySkip pieces are never requested.
+type Priority int
+
+const (
+	PrioritySkip   Priority = 0
+	PriorityLow    Priority = 1
+	PriorityNormal Priority = 4
+	PriorityHigh   Priority = 7
+)
+
+// ParsePriority maps skip, low, normal and high to a Priority
+func ParsePriority(name string) (Priority, error) {
+	switch name {
+	case "skip":
+		return PrioritySkip, nil
+	case "low":
+		return PriorityLow, nil
+	case "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	}
+	return PrioritySkip, fmt.Errorf("unknown priority %q (skip, low, normal or high)", name)
+}
+
 type Piece struct {
-	status string // downloaded, downloading, pending
-	index  uint
-	length uint
-	blocks []*Block
-	mu     sync.Mutex
+	status   string // downloaded, downloading, pending
+	priority Priority
+	deadline time.Time // zero unless the piece is time critical (streaming)
+	// set once the last block is written while the piece gets hashed, so
+	// only one go routine verifies it
+	finishing bool
+	index     uint
+	length    uint
+	blocks    []*Block
+	mu        sync.Mutex
 }
 
 // Should block have a ref of Piece?
@@ -33,11 +65,23 @@ type PieceManager struct {
 	pending     map[int]*Piece
 	downloaded  map[int]*Piece
 	downloading map[int]*Piece
+	skipped     map[int]*Piece // PrioritySkip pieces, kept out of pending
 	pieces      map[int]*Piece
 	PieceLength uint
 	FileLength  uint
 	TotalPieces uint
-	mu          sync.Mutex
+	// How many connected peers have each piece. Peers update it as
+	// bitfield/have messages arrive and when they disconnect.
+	Availability *Availability
+	// closed (and replaced) whenever a piece becomes downloaded, wakes up
+	// everybody waiting on a piece
+	changed chan struct{}
+	mu      sync.Mutex
+}
+
+type Availability struct {
+	counts []int
+	mu     sync.Mutex
 }
 
 func (pieceManager *PieceManager) InitPieces() error {
@@ -49,7 +93,12 @@ func (pieceManager *PieceManager) InitPieces() error {
 	pieceManager.pending = make(map[int]*Piece)
 	pieceManager.downloaded = make(map[int]*Piece)
 	pieceManager.downloading = make(map[int]*Piece)
+	pieceManager.skipped = make(map[int]*Piece)
 	pieceManager.pieces = make(map[int]*Piece)
+	pieceManager.Availability = &Availability{
+		counts: make([]int, pieceManager.TotalPieces),
+	}
+	pieceManager.changed = make(chan struct{})
 
 	for i := uint(1); i <= pieceManager.TotalPieces; i++ {
 		var pieceLength uint
@@ -61,9 +110,10 @@ func (pieceManager *PieceManager) InitPieces() error {
 		}
 
 		piece := &Piece{
-			status: "pending",
-			index:  (i - uint(1)),
-			length: pieceLength,
+			status:   "pending",
+			priority: PriorityNormal,
+			index:    (i - uint(1)),
+			length:   pieceLength,
 		}
 
 		pieceIndex := int(i - uint(1))
@@ -95,19 +145,29 @@ func (pieceManager *PieceManager) initBlocks(piece *Piece, pieceLength uint, las
 	}
 }
 
+// PendingPieces returns a snapshot of the pending pieces map so callers
+// can range over it while pieces move to downloaded
 func (pieceManager *PieceManager) PendingPieces() map[int]*Piece {
 	pieceManager.mu.Lock()
 	defer pieceManager.mu.Unlock()
 
-	return pieceManager.pending
+	pending := make(map[int]*Piece, len(pieceManager.pending))
+	for index, piece := range pieceManager.pending {
+		pending[index] = piece
+	}
+	return pending
 }
 
-// Downloaded returns the downloaded pieces map
+// Downloaded returns a snapshot of the downloaded pieces map
 func (pieceManager *PieceManager) Downloaded() map[int]*Piece {
 	pieceManager.mu.Lock()
 	defer pieceManager.mu.Unlock()
 
-	return pieceManager.downloaded
+	downloaded := make(map[int]*Piece, len(pieceManager.downloaded))
+	for index, piece := range pieceManager.downloaded {
+		downloaded[index] = piece
+	}
+	return downloaded
 }
 
 // GetPiece returns a piece by its index from the pieces map
@@ -118,19 +178,340 @@ func (pieceManager *PieceManager) GetPiece(index int) *Piece {
 	return pieceManager.pieces[index]
 }
 
+// SetPiecePriority changes how eagerly a piece gets picked. Skipping a
+// piece takes it out of pending so nobody requests it, un-skipping puts it
+// back. Downloaded pieces stay downloaded.
+func (pieceManager *PieceManager) SetPiecePriority(index int, priority Priority) error {
+	pieceManager.mu.Lock()
+	defer pieceManager.mu.Unlock()
+
+	piece, exists := pieceManager.pieces[index]
+	if !exists {
+		return fmt.Errorf("piece %d not found", index)
+	}
+
+	piece.mu.Lock()
+	piece.priority = priority
+	piece.mu.Unlock()
+
+	if priority == PrioritySkip {
+		if _, ok := pieceManager.pending[index]; ok {
+			delete(pieceManager.pending, index)
+			piece.status = "skipped"
+			pieceManager.skipped[index] = piece
+		}
+	} else if _, ok := pieceManager.skipped[index]; ok {
+		delete(pieceManager.skipped, index)
+		piece.status = "pending"
+		pieceManager.pending[index] = piece
+	}
+	return nil
+}
+
+// WantedPieces is the number of pieces we are going to download in total,
+// i.e. everything except skipped pieces
+func (pieceManager *PieceManager) WantedPieces() int {
+	pieceManager.mu.Lock()
+	defer pieceManager.mu.Unlock()
+
+	return int(pieceManager.TotalPieces) - len(pieceManager.skipped)
+}
+
+// PiecePriority returns the priority of a piece
+func (pieceManager *PieceManager) PiecePriority(index int) Priority {
+	piece := pieceManager.GetPiece(index)
+	if piece == nil {
+		return PrioritySkip
+	}
+
+	piece.mu.Lock()
+	defer piece.mu.Unlock()
+	return piece.priority
+}
+
+// SetDeadline marks every piece overlapping the byte range
+// [offset, offset+length) as needed by deadline, e.g. the next 20 MB after
+// a video player's playhead. An earlier deadline already set is kept.
+func (pieceManager *PieceManager) SetDeadline(offset, length uint, deadline time.Time) {
+	if length == 0 || offset >= pieceManager.FileLength {
+		return
+	}
+	first := offset / pieceManager.PieceLength
+	last := min(offset+length-1, pieceManager.FileLength-1) / pieceManager.PieceLength
+
+	for index := first; index <= last; index++ {
+		piece := pieceManager.GetPiece(int(index))
+		if piece == nil {
+			continue
+		}
+		piece.mu.Lock()
+		if piece.deadline.IsZero() || deadline.Before(piece.deadline) {
+			piece.deadline = deadline
+		}
+		piece.mu.Unlock()
+	}
+}
+
+// ClearDeadlines drops all deadlines, e.g. when the player seeks elsewhere
+func (pieceManager *PieceManager) ClearDeadlines() {
+	pieceManager.mu.Lock()
+	defer pieceManager.mu.Unlock()
+
+	for _, piece := range pieceManager.pieces {
+		piece.mu.Lock()
+		piece.deadline = time.Time{}
+		piece.mu.Unlock()
+	}
+}
+
+// PieceDeadline returns the piece's deadline, zero time when it has none
+func (pieceManager *PieceManager) PieceDeadline(index int) time.Time {
+	piece := pieceManager.GetPiece(index)
+	if piece == nil {
+		return time.Time{}
+	}
+
+	piece.mu.Lock()
+	defer piece.mu.Unlock()
+	return piece.deadline
+}
+
 // MovePieceToDownloaded moves a piece from pending to downloaded state
 func (pieceManager *PieceManager) MovePieceToDownloaded(index int) error {
 	pieceManager.mu.Lock()
 	defer pieceManager.mu.Unlock()
 
+	// Piece could have been skipped while its last blocks were in flight
 	piece, exists := pieceManager.pending[index]
+	if !exists {
+		piece, exists = pieceManager.skipped[index]
+	}
 	if !exists {
 		return fmt.Errorf("piece %d not found in pending", index)
 	}
 
 	delete(pieceManager.pending, index)
+	delete(pieceManager.skipped, index)
 	piece.status = "downloaded"
 	pieceManager.downloaded[index] = piece
 
+	close(pieceManager.changed)
+	pieceManager.changed = make(chan struct{})
 	return nil
 }
+
+// isDownloaded reports whether the piece is downloaded and verified
+func (pieceManager *PieceManager) isDownloaded(index int) bool {
+	pieceManager.mu.Lock()
+	defer pieceManager.mu.Unlock()
+
+	_, downloaded := pieceManager.downloaded[index]
+	return downloaded
+}
+
+// WaitForPiece blocks until the piece is downloaded (true) or done is
+// closed (false)
+func (pieceManager *PieceManager) WaitForPiece(index int, done <-chan struct{}) bool {
+	for {
+		pieceManager.mu.Lock()
+		_, downloaded := pieceManager.downloaded[index]
+		changed := pieceManager.changed
+		pieceManager.mu.Unlock()
+
+		if downloaded {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// pendingBlock returns the first block of the piece nobody has requested yet
+func (piece *Piece) pendingBlock() *Block {
+	for _, block := range piece.blocks {
+		block.mu.Lock()
+		pending := block.status == "pending"
+		block.mu.Unlock()
+		if pending {
+			return block
+		}
+	}
+	return nil
+}
+
+// startedBlocks counts blocks that are requested or already downloaded.
+// Non-zero means the piece is partially downloaded.
+func (piece *Piece) startedBlocks() int {
+	started := 0
+	for _, block := range piece.blocks {
+		block.mu.Lock()
+		if block.status != "pending" {
+			started++
+		}
+		block.mu.Unlock()
+	}
+	return started
+}
+
+// AddBitfield counts every piece set in a peer's bitfield
+func (availability *Availability) AddBitfield(bitfield []byte) {
+	availability.updateBitfield(bitfield, 1)
+}
+
+// RemoveBitfield undoes AddBitfield when a peer goes away
+func (availability *Availability) RemoveBitfield(bitfield []byte) {
+	availability.updateBitfield(bitfield, -1)
+}
+
+func (availability *Availability) updateBitfield(bitfield []byte, delta int) {
+	if availability == nil {
+		return
+	}
+	availability.mu.Lock()
+	defer availability.mu.Unlock()
+
+	for index := range availability.counts {
+		if bitfieldHas(bitfield, index) {
+			availability.counts[index] += delta
+		}
+	}
+}
+
+// AddPiece counts a single piece announced with a have message
+func (availability *Availability) AddPiece(index int) {
+	if availability == nil {
+		return
+	}
+	availability.mu.Lock()
+	defer availability.mu.Unlock()
+
+	if index >= 0 && index < len(availability.counts) {
+		availability.counts[index]++
+	}
+}
+
+// Count returns number of connected peers having the piece
+func (availability *Availability) Count(index int) int {
+	if availability == nil {
+		return 0
+	}
+	availability.mu.Lock()
+	defer availability.mu.Unlock()
+
+	if index < 0 || index >= len(availability.counts) {
+		return 0
+	}
+	return availability.counts[index]
+}
+
+// Bitfield returns downloaded pieces in the same layout peers use
+func (pieceManager *PieceManager) Bitfield() []byte {
+	pieceManager.mu.Lock()
+	defer pieceManager.mu.Unlock()
+
+	bitfield := make([]byte, (pieceManager.TotalPieces+7)/8)
+	for index := range pieceManager.downloaded {
+		bitfield[index/8] |= 1 << (7 - uint(index%8))
+	}
+	return bitfield
+}
+
+// PartialPieces returns downloaded block indexes of pieces that aren't complete
+func (pieceManager *PieceManager) PartialPieces() map[int][]uint {
+	partial := make(map[int][]uint)
+	for index, piece := range pieceManager.unfinishedPieces() {
+		for _, block := range piece.blocks {
+			block.mu.Lock()
+			if block.status == "downloaded" {
+				partial[index] = append(partial[index], block.blockIndex)
+			}
+			block.mu.Unlock()
+		}
+	}
+	return partial
+}
+
+// MarkBlockDownloaded sets a block's status straight to downloaded, used
+// when restoring resume data
+func (pieceManager *PieceManager) MarkBlockDownloaded(pieceIndex int, blockIndex uint) error {
+	piece := pieceManager.GetPiece(pieceIndex)
+	if piece == nil || int(blockIndex) >= len(piece.blocks) {
+		return fmt.Errorf("block %d of piece %d not found", blockIndex, pieceIndex)
+	}
+
+	block := piece.blocks[blockIndex]
+	block.mu.Lock()
+	block.status = "downloaded"
+	block.mu.Unlock()
+	return nil
+}
+
+// MarkPieceDownloaded marks every block of a piece downloaded and moves the
+// piece to downloaded, used when restoring resume data
+func (pieceManager *PieceManager) MarkPieceDownloaded(index int) error {
+	piece := pieceManager.GetPiece(index)
+	if piece == nil {
+		return fmt.Errorf("piece %d not found", index)
+	}
+
+	for _, block := range piece.blocks {
+		block.mu.Lock()
+		block.status = "downloaded"
+		block.mu.Unlock()
+	}
+	return pieceManager.MovePieceToDownloaded(index)
+}
+
+// ResetPiece forgets everything downloaded for a piece and queues it again
+// (or parks it in skipped if that's its priority)
+func (pieceManager *PieceManager) ResetPiece(index int) {
+	pieceManager.mu.Lock()
+	defer pieceManager.mu.Unlock()
+
+	piece, exists := pieceManager.pieces[index]
+	if !exists {
+		return
+	}
+
+	piece.mu.Lock()
+	piece.finishing = false
+	piece.mu.Unlock()
+	for _, block := range piece.blocks {
+		block.mu.Lock()
+		block.status = "pending"
+		block.mu.Unlock()
+	}
+
+	delete(pieceManager.downloaded, index)
+	delete(pieceManager.pending, index)
+	delete(pieceManager.skipped, index)
+
+	piece.mu.Lock()
+	skip := piece.priority == PrioritySkip
+	piece.mu.Unlock()
+	if skip {
+		piece.status = "skipped"
+		pieceManager.skipped[index] = piece
+	} else {
+		piece.status = "pending"
+		pieceManager.pending[index] = piece
+	}
+}
+
+// unfinishedPieces returns pending and skipped pieces
+func (pieceManager *PieceManager) unfinishedPieces() map[int]*Piece {
+	pieceManager.mu.Lock()
+	defer pieceManager.mu.Unlock()
+
+	pieces := make(map[int]*Piece, len(pieceManager.pending)+len(pieceManager.skipped))
+	for index, piece := range pieceManager.pending {
+		pieces[index] = piece
+	}
+	for index, piece := range pieceManager.skipped {
+		pieces[index] = piece
+	}
+	return pieces
+}
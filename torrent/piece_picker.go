@@ -0,0 +1,263 @@
+package torrent
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// PiecePicker decides which blocks we ask a peer for. It's handed the
+// peer's bitfield and the piece manager and returns up to count blocks in
+// the order they should be requested.
+//
+// Endgame isn't the picker's business, torrent manager handles it once the
+// picker has nothing pending left to offer.
+type PiecePicker interface {
+	PickBlocks(bitfield []byte, pieceManager *PieceManager, count int) []*Block
+}
+
+// PeerPiecePicker is implemented by pickers that also care about which peer
+// they're picking for (its speed compared to the rest). Torrent manager
+// prefers it over PickBlocks when available.
+type PeerPiecePicker interface {
+	PickBlocksForPeer(peer *Peer, peerManager *PeerManager, pieceManager *PieceManager, count int) []*Block
+}
+
+// NewPiecePicker returns a built-in picker by name so the strategy can be
+// chosen per torrent (from a flag, config etc.)
+func NewPiecePicker(name string) (PiecePicker, error) {
+	switch name {
+	case "", "rarest":
+		return &RarestFirstPicker{}, nil
+	case "sequential":
+		return &SequentialPicker{}, nil
+	case "priority":
+		return &PriorityPicker{}, nil
+	case "streaming":
+		return &StreamingPicker{}, nil
+	}
+	return nil, fmt.Errorf("unknown piece picker %q (rarest, sequential, priority or streaming)", name)
+}
+
+// Number of pieces picked at random before switching to rarest first.
+// Rare pieces take the longest to complete, early on we'd rather have
+// something complete to share quickly.
+const randomFirstPieces = 4
+
+// RarestFirstPicker is the default, good for swarm health.
+//
+// Order of preference among pieces the peer has:
+//  1. partially downloaded pieces, the most complete one first
+//  2. a random piece until randomFirstPieces pieces are downloaded
+//  3. rarest piece across connected peers, ties broken randomly
+type RarestFirstPicker struct{}
+
+// Modern RAM bandwidth: ~20–50 GB/s
+// So it's fine to scan all pending pieces for every request.
+func (picker *RarestFirstPicker) PickBlocks(bitfield []byte, pieceManager *PieceManager, count int) []*Block {
+	candidates := candidatePieces(bitfield, pieceManager)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if partial := mostCompletePiece(candidates); partial != nil {
+		return pendingBlocks([]*Piece{partial}, count)
+	}
+
+	if len(pieceManager.Downloaded()) < randomFirstPieces {
+		rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+		return pendingBlocks(candidates, count)
+	}
+
+	return pendingBlocks([]*Piece{rarestPiece(candidates, pieceManager.Availability)}, count)
+}
+
+// SequentialPicker downloads pieces in index order. Terrible for the swarm
+// but it's what you want when data is consumed front to back.
+type SequentialPicker struct{}
+
+func (picker *SequentialPicker) PickBlocks(bitfield []byte, pieceManager *PieceManager, count int) []*Block {
+	return pendingBlocks(candidatePieces(bitfield, pieceManager), count)
+}
+
+// PriorityPicker only looks at the highest priority pieces the peer has and
+// uses Fallback (rarest first when nil) to choose among them.
+type PriorityPicker struct {
+	Fallback PiecePicker
+}
+
+func (picker *PriorityPicker) PickBlocks(bitfield []byte, pieceManager *PieceManager, count int) []*Block {
+	fallback := picker.Fallback
+	if fallback == nil {
+		fallback = &RarestFirstPicker{}
+	}
+
+	candidates := candidatePieces(bitfield, pieceManager)
+	highest := PrioritySkip
+	for _, piece := range candidates {
+		highest = max(highest, pieceManager.PiecePriority(int(piece.index)))
+	}
+
+	// Hide everything below the highest priority from the fallback picker
+	masked := make([]byte, len(bitfield))
+	for _, piece := range candidates {
+		index := int(piece.index)
+		if pieceManager.PiecePriority(index) == highest {
+			masked[index/8] |= 1 << (7 - uint(index%8))
+		}
+	}
+	return fallback.PickBlocks(masked, pieceManager, count)
+}
+
+// Number of fastest peers time critical pieces are requested from
+const defaultFastPeers = 4
+
+// StreamingPicker serves pieces with a deadline (see PieceManager.SetDeadline)
+// first, earliest deadline first, and only from the FastPeers fastest peers
+// so a slow peer can't hold up playback. Once a deadline has passed any peer
+// may take the piece. Everything else goes through Fallback (rarest first
+// when nil).
+type StreamingPicker struct {
+	Fallback  PiecePicker
+	FastPeers int
+}
+
+// Without knowing the peer we can't tell if it's fast, treat it as slow
+func (picker *StreamingPicker) PickBlocks(bitfield []byte, pieceManager *PieceManager, count int) []*Block {
+	return picker.pick(bitfield, false, pieceManager, count)
+}
+
+func (picker *StreamingPicker) PickBlocksForPeer(peer *Peer, peerManager *PeerManager, pieceManager *PieceManager, count int) []*Block {
+	fastPeers := picker.FastPeers
+	if fastPeers <= 0 {
+		fastPeers = defaultFastPeers
+	}
+
+	fastest := peerManager.FastestPeers(fastPeers)
+	// Until we've measured enough peers everyone counts as fast
+	fast := len(fastest) < fastPeers || containsPeer(fastest, peer)
+
+	return picker.pick(peer.bitfieldCopy(), fast, pieceManager, count)
+}
+
+func (picker *StreamingPicker) pick(bitfield []byte, fast bool, pieceManager *PieceManager, count int) []*Block {
+	fallback := picker.Fallback
+	if fallback == nil {
+		fallback = &RarestFirstPicker{}
+	}
+
+	now := time.Now()
+	var critical []*Piece
+	// Deadline pieces a slow peer can't have yet, hidden from the fallback
+	// picker too or rarest first would hand them out anyway
+	var withheld []int
+	for _, piece := range candidatePieces(bitfield, pieceManager) {
+		index := int(piece.index)
+		deadline := pieceManager.PieceDeadline(index)
+		if deadline.IsZero() {
+			continue
+		}
+		if fast || deadline.Before(now) {
+			critical = append(critical, piece)
+		} else {
+			withheld = append(withheld, index)
+		}
+	}
+
+	if len(critical) == 0 {
+		if len(withheld) > 0 {
+			masked := make([]byte, len(bitfield))
+			copy(masked, bitfield)
+			for _, index := range withheld {
+				masked[index/8] &^= 1 << (7 - uint(index%8))
+			}
+			bitfield = masked
+		}
+		return fallback.PickBlocks(bitfield, pieceManager, count)
+	}
+
+	sort.SliceStable(critical, func(i, j int) bool {
+		return pieceManager.PieceDeadline(int(critical[i].index)).Before(pieceManager.PieceDeadline(int(critical[j].index)))
+	})
+	return pendingBlocks(critical, count)
+}
+
+// candidatePieces returns pending pieces the peer has that still have a
+// block nobody requested, sorted by index. Skipped pieces are left out.
+func candidatePieces(bitfield []byte, pieceManager *PieceManager) []*Piece {
+	var candidates []*Piece
+	for index, piece := range pieceManager.PendingPieces() {
+		if !bitfieldHas(bitfield, index) || pieceManager.PiecePriority(index) == PrioritySkip {
+			continue
+		}
+		if piece.pendingBlock() == nil {
+			continue
+		}
+		candidates = append(candidates, piece)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].index < candidates[j].index
+	})
+	return candidates
+}
+
+// mostCompletePiece returns the piece with the most requested/downloaded
+// blocks, nil when no piece has been started
+func mostCompletePiece(pieces []*Piece) *Piece {
+	var partial *Piece
+	partialStarted := 0
+	for _, piece := range pieces {
+		started := piece.startedBlocks()
+		if started > partialStarted {
+			partial = piece
+			partialStarted = started
+		}
+	}
+	return partial
+}
+
+// rarestPiece picks the piece fewest connected peers have. Ties are broken
+// randomly (reservoir sampling) so that peers don't all chase the same piece.
+func rarestPiece(pieces []*Piece, availability *Availability) *Piece {
+	var rarest *Piece
+	rarestCount := 0
+	ties := 0
+	for _, piece := range pieces {
+		count := availability.Count(int(piece.index))
+		switch {
+		case rarest == nil || count < rarestCount:
+			rarest = piece
+			rarestCount = count
+			ties = 1
+		case count == rarestCount:
+			ties++
+			if rand.Intn(ties) == 0 {
+				rarest = piece
+			}
+		}
+	}
+	return rarest
+}
+
+// pendingBlocks collects up to count unrequested blocks walking pieces in order
+func pendingBlocks(pieces []*Piece, count int) []*Block {
+	var blocks []*Block
+	for _, piece := range pieces {
+		for _, block := range piece.blocks {
+			if len(blocks) >= count {
+				return blocks
+			}
+			block.mu.Lock()
+			pending := block.status == "pending"
+			block.mu.Unlock()
+			if pending {
+				blocks = append(blocks, block)
+			}
+		}
+	}
+	return blocks
+}
@@ -0,0 +1,56 @@
+package torrent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter caps bytes per second across everything sharing it. It's a
+// token bucket holding up to a second worth of bytes, a transfer bigger
+// than that goes through and the next ones wait it off.
+type RateLimiter struct {
+	bytesPerSecond int64
+	tokens         float64
+	last           time.Time
+	mu             sync.Mutex
+}
+
+// NewRateLimiter returns a limiter for bytesPerSecond, 0 or less means no
+// limit
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{
+		bytesPerSecond: bytesPerSecond,
+		tokens:         float64(bytesPerSecond),
+		last:           time.Now(),
+	}
+}
+
+// Wait takes n bytes and blocks until they fit under the limit or ctx is
+// done. A nil limiter never waits.
+func (limiter *RateLimiter) Wait(ctx context.Context, n int) error {
+	if limiter == nil || limiter.bytesPerSecond <= 0 {
+		return nil
+	}
+
+	limiter.mu.Lock()
+	now := time.Now()
+	rate := float64(limiter.bytesPerSecond)
+	limiter.tokens = min(limiter.tokens+now.Sub(limiter.last).Seconds()*rate, rate)
+	limiter.last = now
+	limiter.tokens -= float64(n)
+	wait := time.Duration(-limiter.tokens / rate * float64(time.Second))
+	limiter.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
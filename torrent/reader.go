@@ -0,0 +1,179 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Bytes fetched ahead of the read position by default
+const defaultReadahead = 4 * 1024 * 1024
+
+// Returned by reads on a closed Reader, including reads that were waiting
+// for a piece when Close was called
+var ErrReaderClosed = errors.New("reader closed")
+
+// Reader reads one file of a torrent while it downloads. Pieces under the
+// read position (plus Readahead) are requested before anything else and a
+// read waits until they're verified, so it only ever returns good data.
+//
+// Read and Seek move a position and aren't safe for concurrent use, ReadAt
+// is. Close the reader once done or its pieces stay prioritised.
+type Reader struct {
+	// Bytes past the read position to get requested as well, so data is
+	// ready by the time it's read
+	Readahead int64
+
+	tm      *TorrentManager
+	torrent *Torrent
+	offset  int64 // where the file starts within the torrent
+	length  int64
+	pos     int64
+	// pieces this reader asked for, handed back on Close at the latest
+	raised    map[int]bool
+	done      chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+}
+
+// Read returns as soon as the piece under the read position is in, which
+// can be less than len(p)
+func (reader *Reader) Read(p []byte) (int, error) {
+	n, err := reader.readPiece(p, reader.pos, true)
+	reader.pos += int64(n)
+	return n, err
+}
+
+// ReadAt waits until all of p can be filled (or the file ends)
+func (reader *Reader) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+
+	read := 0
+	for read < len(p) {
+		n, err := reader.readPiece(p[read:], offset+int64(read), false)
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func (reader *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += reader.pos
+	case io.SeekEnd:
+		offset += reader.length
+	default:
+		return reader.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return reader.pos, fmt.Errorf("negative position %d", offset)
+	}
+	reader.pos = offset
+	return offset, nil
+}
+
+// Close unblocks pending reads and gives up the reader's claim on pieces
+func (reader *Reader) Close() error {
+	reader.close()
+	reader.torrent.forgetReader(reader)
+	return nil
+}
+
+// close is Close without telling the torrent, which may be the one closing
+func (reader *Reader) close() {
+	reader.closeOnce.Do(func() {
+		close(reader.done)
+
+		reader.mu.Lock()
+		defer reader.mu.Unlock()
+		var indexes []int
+		for index := range reader.raised {
+			indexes = append(indexes, index)
+		}
+		reader.raised = nil
+		reader.tm.lowerReaderPieces(indexes)
+	})
+}
+
+// Size of the file
+func (reader *Reader) Size() int64 {
+	return reader.length
+}
+
+// readPiece reads from offset (relative to the file) up to the end of the
+// piece it falls in, waiting for the piece first
+func (reader *Reader) readPiece(p []byte, offset int64, sequential bool) (int, error) {
+	select {
+	case <-reader.done:
+		return 0, ErrReaderClosed
+	default:
+	}
+	if offset >= reader.length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	pieceLength := reader.tm.DiskManager.TorrentFileInfo.PieceLength
+	torrentOffset := reader.offset + offset
+	piece := int(torrentOffset / pieceLength)
+	pieceOffset := torrentOffset - int64(piece)*pieceLength
+	p = p[:min(int64(len(p)), reader.length-offset, pieceLength-pieceOffset)]
+
+	reader.want(torrentOffset, int64(len(p)), sequential)
+	if !reader.tm.PieceManager.WaitForPiece(piece, reader.done) {
+		return 0, ErrReaderClosed
+	}
+
+	n, err := reader.tm.DiskManager.readAt(piece, p, pieceOffset)
+	if err == nil && n < len(p) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// want claims the pieces from torrentOffset to Readahead past the read and
+// gives back those that are downloaded by now. Sequential reads also give
+// back everything outside that window (behind the position, or ahead of it
+// after a seek), concurrent ReadAt calls can't since they'd take pieces
+// away from each other.
+func (reader *Reader) want(torrentOffset, length int64, sequential bool) {
+	pieceLength := reader.tm.DiskManager.TorrentFileInfo.PieceLength
+	windowEnd := min(torrentOffset+length+max(reader.Readahead, 0), reader.offset+reader.length)
+	first := int(torrentOffset / pieceLength)
+	last := int((windowEnd - 1) / pieceLength)
+
+	reader.mu.Lock()
+	defer reader.mu.Unlock()
+	if reader.raised == nil {
+		return
+	}
+
+	var lower []int
+	for index := range reader.raised {
+		outside := index < first || index > last
+		if reader.tm.PieceManager.isDownloaded(index) || sequential && outside {
+			lower = append(lower, index)
+			delete(reader.raised, index)
+		}
+	}
+
+	var raise []int
+	for index := first; index <= last; index++ {
+		if !reader.raised[index] && !reader.tm.PieceManager.isDownloaded(index) {
+			raise = append(raise, index)
+			reader.raised[index] = true
+		}
+	}
+
+	reader.tm.lowerReaderPieces(lower)
+	reader.tm.raiseReaderPieces(raise)
+}
@@ -0,0 +1,156 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// RecheckResult is the outcome of hashing existing data against the
+// torrent. Missing pieces couldn't be read or are all zeroes (never
+// downloaded), corrupt ones have data that doesn't match the hash.
+type RecheckResult struct {
+	Verified []int
+	Missing  []int
+	Corrupt  []int
+	Files    []FileCheck
+}
+
+// FileCheck summarises a recheck for one file. A piece spanning several
+// files is counted in each of them.
+type FileCheck struct {
+	Path    string
+	Pieces  int
+	Missing int
+	Corrupt int
+}
+
+type pieceCheck string
+
+const (
+	pieceVerified pieceCheck = "verified"
+	pieceMissing  pieceCheck = "missing"
+	pieceCorrupt  pieceCheck = "corrupt"
+)
+
+// Recheck hashes everything on disk and rebuilds the piece manager's state
+// from it: verified pieces become downloaded, everything else goes back to
+// pending. Whatever resume data said is thrown away. Has to run after
+// ScaffoldFiles and before Download.
+func (tm *TorrentManager) Recheck() (*RecheckResult, error) {
+	tm.log().Info("rechecking existing data")
+
+	result, err := checkPieces(tm.DiskManager, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for index := 0; index < int(tm.PieceManager.TotalPieces); index++ {
+		tm.PieceManager.ResetPiece(index)
+	}
+	for _, index := range result.Verified {
+		err = tm.PieceManager.MarkPieceDownloaded(index)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tm.log().Info("recheck done",
+		"verified", len(result.Verified), "missing", len(result.Missing), "corrupt", len(result.Corrupt))
+	return result, nil
+}
+
+// VerifyData checks the data in savePath against the torrent without
+// creating or changing anything on disk. Backs the `verify` command.
+func VerifyData(tfi *TorrentFileInfo, savePath string, workers int) (*RecheckResult, error) {
+	diskManager := &DiskManager{
+		TorrentFileInfo: tfi,
+		SavePath:        savePath,
+	}
+
+	err := diskManager.MapFiles()
+	if err != nil {
+		return nil, err
+	}
+	// Nothing was written, closing just lets go of the file handles
+	defer diskManager.Storage.Close()
+	return checkPieces(diskManager, workers)
+}
+
+// checkPieces reads and hashes every piece through the disk manager using
+// workers go routines (one per CPU when workers <= 0)
+func checkPieces(diskManager *DiskManager, workers int) (*RecheckResult, error) {
+	tfi := diskManager.TorrentFileInfo
+	if len(tfi.PieceHashes) != int(tfi.TotalPieces) {
+		return nil, fmt.Errorf("torrent has no piece hashes to check against")
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	checks := make([]pieceCheck, tfi.TotalPieces)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				checks[index] = checkPiece(diskManager, index)
+			}
+		}()
+	}
+
+	for index := range checks {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	result := &RecheckResult{}
+	for index, check := range checks {
+		switch check {
+		case pieceVerified:
+			result.Verified = append(result.Verified, index)
+		case pieceMissing:
+			result.Missing = append(result.Missing, index)
+		case pieceCorrupt:
+			result.Corrupt = append(result.Corrupt, index)
+		}
+	}
+
+	for _, file := range diskManager.filePieces() {
+		fileCheck := FileCheck{Path: file.path}
+		for index := file.first; index <= file.last; index++ {
+			fileCheck.Pieces++
+			switch checks[index] {
+			case pieceMissing:
+				fileCheck.Missing++
+			case pieceCorrupt:
+				fileCheck.Corrupt++
+			}
+		}
+		result.Files = append(result.Files, fileCheck)
+	}
+	return result, nil
+}
+
+func checkPiece(diskManager *DiskManager, index int) pieceCheck {
+	data, err := diskManager.ReadPiece(index)
+	if err != nil {
+		return pieceMissing
+	}
+
+	if sha1.Sum(data) == diskManager.TorrentFileInfo.PieceHashes[index] {
+		return pieceVerified
+	}
+
+	// Preallocated but never written
+	if bytes.Count(data, []byte{0}) == len(data) {
+		return pieceMissing
+	}
+	return pieceCorrupt
+}
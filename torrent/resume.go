@@ -0,0 +1,185 @@
+package torrent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// How often the event loop persists resume data while downloading
+const resumeSaveInterval = 30 * time.Second
+
+// ResumeData is what we need to pick a download up after a restart without
+// throwing away progress. Stored as JSON next to the downloaded files
+// (see DiskManager.resumeFilePath).
+type ResumeData struct {
+	InfoHash string `json:"info_hash"`
+	// Pieces that were completely downloaded, same layout as a peer bitfield
+	Bitfield []byte `json:"bitfield"`
+	// Piece index -> downloaded block indexes for pieces that weren't complete
+	PartialPieces  map[int][]uint   `json:"partial_pieces"`
+	FilePriorities map[int]Priority `json:"file_priorities"`
+	Downloaded     int64            `json:"downloaded"`
+	ActiveSeconds  int64            `json:"active_seconds"`
+}
+
+// SaveResumeData writes the current state to the resume file. Writes to a
+// temp file first and renames so a crash mid write can't corrupt it.
+func (tm *TorrentManager) SaveResumeData() error {
+	// Nothing to resume, in-memory data is gone with the process
+	if tm.DiskManager.StorageType == StorageMemory {
+		return nil
+	}
+
+	resumeData := &ResumeData{
+		InfoHash:       tm.DiskManager.TorrentFileInfo.InfoHash,
+		Bitfield:       tm.PieceManager.Bitfield(),
+		PartialPieces:  make(map[int][]uint),
+		FilePriorities: tm.DiskManager.FilePriorityMap(),
+	}
+
+	// Blocks still sitting in the write cache aren't on disk yet
+	for index, blocks := range tm.PieceManager.PartialPieces() {
+		for _, blockIndex := range blocks {
+			if !tm.DiskManager.isBlockBuffered(index, blockIndex) {
+				resumeData.PartialPieces[index] = append(resumeData.PartialPieces[index], blockIndex)
+			}
+		}
+	}
+
+	tm.mu.Lock()
+	resumeData.Downloaded = tm.downloaded
+	resumeData.ActiveSeconds = tm.activeSeconds
+	if !tm.startedAt.IsZero() {
+		resumeData.ActiveSeconds += int64(time.Since(tm.startedAt).Seconds())
+	}
+	tm.mu.Unlock()
+
+	data, err := json.Marshal(resumeData)
+	if err != nil {
+		return err
+	}
+
+	// Not while Move is taking the resume file elsewhere
+	tm.DiskManager.ioMu.RLock()
+	defer tm.DiskManager.ioMu.RUnlock()
+
+	path := tm.DiskManager.resumeFilePath()
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0666)
+	if err != nil {
+		return fmt.Errorf("writing resume data: %w", err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// LoadResumeData restores progress from the resume file, if there is one.
+// Has to run after PieceManager.InitPieces and before
+// DiskManager.ScaffoldFiles, file priorities from the resume file decide
+// which files get created. Priorities already in DiskManager.FilePriorities
+// (e.g. from the command line) win over saved ones.
+func (tm *TorrentManager) LoadResumeData() error {
+	if tm.DiskManager.StorageType == StorageMemory {
+		return nil
+	}
+
+	data, err := os.ReadFile(tm.DiskManager.resumeFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading resume data: %w", err)
+	}
+
+	resumeData := &ResumeData{}
+	err = json.Unmarshal(data, resumeData)
+	if err != nil {
+		return fmt.Errorf("parsing resume data: %w", err)
+	}
+
+	if resumeData.InfoHash != tm.DiskManager.TorrentFileInfo.InfoHash {
+		return fmt.Errorf("resume data is for torrent %s", resumeData.InfoHash)
+	}
+	if len(resumeData.Bitfield) != int((tm.PieceManager.TotalPieces+7)/8) {
+		return fmt.Errorf("resume data bitfield has %d bytes, expected %d",
+			len(resumeData.Bitfield), (tm.PieceManager.TotalPieces+7)/8)
+	}
+
+	// Everything is checked before anything is applied, callers carry on
+	// without the resume data when it's bad
+	for index := 0; index < int(tm.PieceManager.TotalPieces); index++ {
+		if !bitfieldHas(resumeData.Bitfield, index) {
+			continue
+		}
+		if tm.PieceManager.GetPiece(index) == nil || tm.PieceManager.isDownloaded(index) {
+			return fmt.Errorf("resume data has piece %d that can't be restored", index)
+		}
+	}
+	for index, blocks := range resumeData.PartialPieces {
+		piece := tm.PieceManager.GetPiece(index)
+		if piece == nil {
+			return fmt.Errorf("resume data has unknown partial piece %d", index)
+		}
+		for _, blockIndex := range blocks {
+			if int(blockIndex) >= len(piece.blocks) {
+				return fmt.Errorf("resume data has unknown block %d of piece %d", blockIndex, index)
+			}
+		}
+	}
+
+	if tm.DiskManager.FilePriorities == nil {
+		tm.DiskManager.FilePriorities = make(map[int]Priority)
+	}
+	for index, priority := range resumeData.FilePriorities {
+		if _, ok := tm.DiskManager.FilePriorities[index]; !ok {
+			tm.DiskManager.FilePriorities[index] = priority
+		}
+	}
+
+	restored := 0
+	for index := 0; index < int(tm.PieceManager.TotalPieces); index++ {
+		if !bitfieldHas(resumeData.Bitfield, index) {
+			continue
+		}
+		err = tm.PieceManager.MarkPieceDownloaded(index)
+		if err != nil {
+			return err
+		}
+		restored++
+	}
+
+	for index, blocks := range resumeData.PartialPieces {
+		for _, blockIndex := range blocks {
+			err = tm.PieceManager.MarkBlockDownloaded(index, blockIndex)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	tm.mu.Lock()
+	tm.downloaded = resumeData.Downloaded
+	tm.activeSeconds = resumeData.ActiveSeconds
+	tm.mu.Unlock()
+
+	tm.log().Info("resumed from resume data",
+		"pieces", restored, "total", tm.PieceManager.TotalPieces, "partial", len(resumeData.PartialPieces))
+	return nil
+}
+
+// dropMissingResumedData re-queues pieces restored from resume data whose
+// files had to be created from scratch (deleted since the last run etc.)
+func (tm *TorrentManager) dropMissingResumedData() {
+	for index := range tm.PieceManager.Downloaded() {
+		if !tm.DiskManager.pieceOnDisk(index) {
+			tm.log().Warn("piece is gone from disk, downloading it again", "piece", index)
+			tm.PieceManager.ResetPiece(index)
+		}
+	}
+	for index := range tm.PieceManager.PartialPieces() {
+		if !tm.DiskManager.pieceOnDisk(index) {
+			tm.PieceManager.ResetPiece(index)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package torrent
+
+import (
+	"time"
+)
+
+// Stats is a snapshot of how a torrent is doing
+type Stats struct {
+	State string
+	// Bytes in the whole torrent, and still to download of the wanted
+	// files
+	Length    int64
+	BytesLeft int64
+	// Bytes received and written, over every run. Pieces that fail their
+	// hash check count too, they're downloaded again. It's what trackers
+	// are told.
+	Downloaded int64
+	// Verified pieces, pieces of wanted files and pieces in the torrent
+	PiecesDone   int
+	PiecesWanted int
+	PiecesTotal  int
+	// Connected peers and how fast they send us data together, in bytes
+	// per second
+	Peers        int
+	DownloadRate float64
+	// How long the torrent has been running, over every run
+	ActiveTime time.Duration
+}
+
+// Stats returns the torrent's current stats
+func (t *Torrent) Stats() Stats {
+	tm := t.manager
+
+	stats := Stats{
+		State:        t.State(),
+		Length:       tm.DiskManager.TorrentFileInfo.FileLength,
+		BytesLeft:    tm.bytesLeft(),
+		PiecesDone:   len(tm.PieceManager.Downloaded()),
+		PiecesWanted: tm.PieceManager.WantedPieces(),
+		PiecesTotal:  int(tm.PieceManager.TotalPieces),
+	}
+
+	tm.mu.Lock()
+	stats.Downloaded = tm.downloaded
+	stats.ActiveTime = time.Duration(tm.activeSeconds) * time.Second
+	if !tm.startedAt.IsZero() {
+		stats.ActiveTime += time.Since(tm.startedAt)
+	}
+	tm.mu.Unlock()
+
+	peerManager := tm.PeerManager
+	peerManager.mu.Lock()
+	for _, peer := range peerManager.Peers {
+		switch peer.Status() {
+		case "connecting", "idle", "active":
+			stats.Peers++
+			stats.DownloadRate += peer.DownloadRate()
+		}
+	}
+	peerManager.mu.Unlock()
+
+	return stats
+}
@@ -0,0 +1,199 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+)
+
+// Storage is where piece data lives. Offsets are relative to the start of
+// the piece. Disk manager owns the layout (which files exist, priorities),
+// a storage only moves bytes.
+type Storage interface {
+	ReadAt(piece int, p []byte, offset int64) (int, error)
+	WriteAt(piece int, p []byte, offset int64) (int, error)
+	// MarkComplete is called once every block of a piece has been written
+	MarkComplete(piece int) error
+	Close() error
+}
+
+// StorageType picks a built-in Storage per torrent
+type StorageType string
+
+const (
+	// Plain files, kept open in a pool of handles
+	StorageFile StorageType = "file"
+	// Files mapped into memory, good for large sequential workloads
+	StorageMmap StorageType = "mmap"
+	// Nothing touches the disk. Tests and ephemeral downloads.
+	StorageMemory StorageType = "memory"
+)
+
+func newStorage(storageType StorageType, files *filesMap) (Storage, error) {
+	switch storageType {
+	case "", StorageFile:
+		return &fileStorage{files: files, pool: newFilePool(defaultMaxOpenFiles)}, nil
+	case StorageMmap:
+		return newMmapStorage(files)
+	case StorageMemory:
+		return newMemoryStorage(files), nil
+	}
+	return nil, fmt.Errorf("unknown storage %q (file, mmap or memory)", storageType)
+}
+
+// Torrent data is one contiguous byte range cut into files. A block (or a
+// whole piece) can start in one file and end several files later, tiny and
+// zero-length files included, so every read/write is split into spans, one
+// per file it touches.
+type fileSpan struct {
+	file       *fileData
+	fileOffset int64 // where the span starts inside the file
+	dataOffset int64 // where the span starts inside the caller's buffer
+	length     int64
+}
+
+// spans splits [offset, offset+length) across the files. Zero-length files
+// never get a span. Caller holds filesMap.mu
+func (filesMap *filesMap) spans(offset, length int64) ([]fileSpan, error) {
+	var spans []fileSpan
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid range offset=%d length=%d", offset, length)
+	}
+
+	end := offset + length
+	covered := int64(0)
+	for i := range filesMap.filesData {
+		fileData := &filesMap.filesData[i]
+		start := max(offset, fileData.offsetStart)
+		stop := min(end, fileData.offsetEnd)
+		if start >= stop {
+			continue
+		}
+
+		spans = append(spans, fileSpan{
+			file:       fileData,
+			fileOffset: start - fileData.offsetStart,
+			dataOffset: start - offset,
+			length:     stop - start,
+		})
+		covered += stop - start
+	}
+
+	if covered != length {
+		return nil, fmt.Errorf("range offset=%d length=%d is outside of torrent data", offset, length)
+	}
+	return spans, nil
+}
+
+// fileLocation is a span resolved to the file on disk holding its bytes
+type fileLocation struct {
+	path       string
+	fileOffset int64
+	dataOffset int64
+	length     int64
+	fileSize   int64 // size the file on disk is supposed to have
+}
+
+// locate resolves a piece relative range to the files holding it. Skipped
+// files that were never created are backed by the part file, which mirrors
+// the torrent's byte layout. Resolved up front so no lock is held during
+// the actual I/O.
+func (filesMap *filesMap) locate(piece int, offset, length int64) ([]fileLocation, error) {
+	filesMap.mu.RLock()
+	defer filesMap.mu.RUnlock()
+
+	spans, err := filesMap.spans(int64(piece)*filesMap.pieceLength+offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	locations := make([]fileLocation, len(spans))
+	for i, span := range spans {
+		locations[i] = fileLocation{
+			path:       span.file.filePath,
+			fileOffset: span.fileOffset,
+			dataOffset: span.dataOffset,
+			length:     span.length,
+			fileSize:   span.file.fileSize,
+		}
+		if !span.file.created {
+			locations[i].path = filesMap.partFilePath
+			locations[i].fileOffset = span.file.offsetStart + span.fileOffset
+			locations[i].fileSize = filesMap.totalLength
+		}
+	}
+	return locations, nil
+}
+
+// fileStorage reads and writes files with positional I/O through a pool
+// of open handles. Writes to different files (or different parts of one
+// file) don't wait on each other.
+type fileStorage struct {
+	files *filesMap
+	pool  *filePool
+}
+
+func (storage *fileStorage) WriteAt(piece int, p []byte, offset int64) (int, error) {
+	locations, err := storage.files.locate(piece, offset, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for _, location := range locations {
+		pooled, err := storage.pool.acquire(location.path, true)
+		if err != nil {
+			return written, err
+		}
+		if !pooled.writable {
+			storage.pool.release(pooled)
+			return written, fmt.Errorf("%s is not writable", location.path)
+		}
+
+		n, err := pooled.file.WriteAt(p[location.dataOffset:location.dataOffset+location.length], location.fileOffset)
+		storage.pool.release(pooled)
+		written += n
+		if err != nil {
+			return written, fmt.Errorf("writing %s at offset %d: %w", location.path, location.fileOffset, err)
+		}
+	}
+	return written, nil
+}
+
+func (storage *fileStorage) ReadAt(piece int, p []byte, offset int64) (int, error) {
+	locations, err := storage.files.locate(piece, offset, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+
+	read := 0
+	for _, location := range locations {
+		pooled, err := storage.pool.acquire(location.path, false)
+		if err != nil {
+			return read, err
+		}
+
+		buf := p[location.dataOffset : location.dataOffset+location.length]
+		n, err := pooled.file.ReadAt(buf, location.fileOffset)
+		storage.pool.release(pooled)
+		// Files that aren't preallocated only grow as they're written, the
+		// bytes past the end read as zeros like a hole in a sparse file would
+		if err == io.EOF {
+			clear(buf[n:])
+			n, err = len(buf), nil
+		}
+		read += n
+		if err != nil {
+			return read, fmt.Errorf("reading %s at offset %d: %w", location.path, location.fileOffset, err)
+		}
+	}
+	return read, nil
+}
+
+// Every write already went straight to the file
+func (storage *fileStorage) MarkComplete(piece int) error {
+	return nil
+}
+
+func (storage *fileStorage) Close() error {
+	return storage.pool.Close()
+}
@@ -0,0 +1,77 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+)
+
+// memoryStorage keeps pieces in memory, allocated as they're first written.
+// Pieces never written read back as zeroes, like a sparse file.
+type memoryStorage struct {
+	pieceLength int64
+	totalLength int64
+	pieces      map[int][]byte
+	mu          sync.Mutex
+}
+
+func newMemoryStorage(files *filesMap) *memoryStorage {
+	return &memoryStorage{
+		pieceLength: files.pieceLength,
+		totalLength: files.totalLength,
+		pieces:      make(map[int][]byte),
+	}
+}
+
+// piece returns the piece's buffer, bounds checking the range first
+func (storage *memoryStorage) piece(piece int, offset int64, length int, allocate bool) ([]byte, error) {
+	pieceStart := int64(piece) * storage.pieceLength
+	pieceSize := min(storage.pieceLength, storage.totalLength-pieceStart)
+	if piece < 0 || pieceSize <= 0 || offset < 0 || offset+int64(length) > pieceSize {
+		return nil, fmt.Errorf("range piece=%d offset=%d length=%d is outside of torrent data", piece, offset, length)
+	}
+
+	data, ok := storage.pieces[piece]
+	if !ok && allocate {
+		data = make([]byte, pieceSize)
+		storage.pieces[piece] = data
+	}
+	return data, nil
+}
+
+func (storage *memoryStorage) WriteAt(piece int, p []byte, offset int64) (int, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	data, err := storage.piece(piece, offset, len(p), true)
+	if err != nil {
+		return 0, err
+	}
+	return copy(data[offset:], p), nil
+}
+
+func (storage *memoryStorage) ReadAt(piece int, p []byte, offset int64) (int, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	data, err := storage.piece(piece, offset, len(p), false)
+	if err != nil {
+		return 0, err
+	}
+	if data == nil {
+		clear(p)
+		return len(p), nil
+	}
+	return copy(p, data[offset:]), nil
+}
+
+func (storage *memoryStorage) MarkComplete(piece int) error {
+	return nil
+}
+
+func (storage *memoryStorage) Close() error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	storage.pieces = make(map[int][]byte)
+	return nil
+}
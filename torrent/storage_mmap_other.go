@@ -0,0 +1,9 @@
+//go:build !unix
+
+package torrent
+
+import "fmt"
+
+func newMmapStorage(files *filesMap) (Storage, error) {
+	return nil, fmt.Errorf("mmap storage is only supported on unix")
+}
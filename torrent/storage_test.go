@@ -0,0 +1,207 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestFilesMap lays files of the given sizes out back to back in dir,
+// every file created unless skipped says otherwise
+func newTestFilesMap(dir string, pieceLength int64, sizes []int64, skipped ...int) *filesMap {
+	filesMap := &filesMap{
+		partFilePath: filepath.Join(dir, ".parts"),
+		pieceLength:  pieceLength,
+	}
+	offset := int64(0)
+	for i, size := range sizes {
+		path := filepath.Join(dir, fmt.Sprintf("file%d", i))
+		filesMap.filesData = append(filesMap.filesData, fileData{
+			filePath:    path,
+			finalPath:   path,
+			fileSize:    size,
+			offsetStart: offset,
+			offsetEnd:   offset + size,
+			created:     true,
+		})
+		offset += size
+	}
+	for _, i := range skipped {
+		filesMap.filesData[i].created = false
+	}
+	filesMap.totalLength = offset
+	return filesMap
+}
+
+// span by file index, easier to write down than *fileData
+type testSpan struct {
+	file                           int
+	fileOffset, dataOffset, length int64
+}
+
+func TestFilesMapSpans(t *testing.T) {
+	// Zero-length files at both ends and in the middle, files of a byte or
+	// three between them. 29 bytes, pieces of 16.
+	layout := []int64{0, 5, 0, 3, 1, 0, 20, 0}
+
+	tests := []struct {
+		name           string
+		offset, length int64
+		want           []testSpan
+		wantErr        bool
+	}{
+		{
+			name:   "zero-length file at the start",
+			offset: 0, length: 5,
+			want: []testSpan{{1, 0, 0, 5}},
+		},
+		{
+			name:   "zero-length file in the middle",
+			offset: 3, length: 4,
+			want: []testSpan{{1, 3, 0, 2}, {3, 0, 2, 2}},
+		},
+		{
+			name:   "piece covering more than 3 files",
+			offset: 0, length: 16,
+			want: []testSpan{{1, 0, 0, 5}, {3, 0, 5, 3}, {4, 0, 8, 1}, {6, 0, 9, 7}},
+		},
+		{
+			name:   "files smaller than the block",
+			offset: 4, length: 6,
+			want: []testSpan{{1, 4, 0, 1}, {3, 0, 1, 3}, {4, 0, 4, 1}, {6, 0, 5, 1}},
+		},
+		{
+			name:   "single byte file alone",
+			offset: 8, length: 1,
+			want: []testSpan{{4, 0, 0, 1}},
+		},
+		{
+			name:   "last piece, zero-length file at the end",
+			offset: 16, length: 13,
+			want: []testSpan{{6, 7, 0, 13}},
+		},
+		{
+			name:   "empty range",
+			offset: 5, length: 0,
+		},
+		{
+			name:   "past the end",
+			offset: 20, length: 10,
+			wantErr: true,
+		},
+		{
+			name:   "negative offset",
+			offset: -1, length: 2,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filesMap := newTestFilesMap(t.TempDir(), 16, layout)
+			spans, err := filesMap.spans(test.offset, test.length)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got spans %v", spans)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []testSpan
+			for _, span := range spans {
+				file := -1
+				for i := range filesMap.filesData {
+					if span.file == &filesMap.filesData[i] {
+						file = i
+					}
+				}
+				got = append(got, testSpan{file, span.fileOffset, span.dataOffset, span.length})
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Fatalf("got spans %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFilesMapLocateSkippedFile(t *testing.T) {
+	dir := t.TempDir()
+	// file2 (bytes 6 to 10) is skipped, its bytes live in the part file
+	// at torrent offsets
+	filesMap := newTestFilesMap(dir, 8, []int64{6, 0, 4, 6}, 2)
+
+	locations, err := filesMap.locate(1, 0, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []fileLocation{
+		{path: filesMap.partFilePath, fileOffset: 8, dataOffset: 0, length: 2, fileSize: 16},
+		{path: filepath.Join(dir, "file3"), fileOffset: 0, dataOffset: 2, length: 6, fileSize: 6},
+	}
+	if fmt.Sprint(locations) != fmt.Sprint(want) {
+		t.Fatalf("got locations %+v, want %+v", locations, want)
+	}
+}
+
+func TestFileStorageAcrossFiles(t *testing.T) {
+	dir := t.TempDir()
+	sizes := []int64{0, 3, 1, 0, 17, 2, 0, 9, 0}
+	filesMap := newTestFilesMap(dir, 8, sizes, 5)
+
+	data := make([]byte, filesMap.totalLength)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+
+	storage := &fileStorage{files: filesMap, pool: newFilePool(2)}
+	defer storage.Close()
+
+	// Piece by piece, split in blocks of 3 so blocks straddle files too
+	for piece := int64(0); piece*8 < filesMap.totalLength; piece++ {
+		pieceData := data[piece*8 : min((piece+1)*8, filesMap.totalLength)]
+		for offset := 0; offset < len(pieceData); offset += 3 {
+			block := pieceData[offset:min(offset+3, len(pieceData))]
+			n, err := storage.WriteAt(int(piece), block, int64(offset))
+			if err != nil || n != len(block) {
+				t.Fatalf("writing piece %d at %d: n=%d err=%v", piece, offset, n, err)
+			}
+		}
+
+		read := make([]byte, len(pieceData))
+		n, err := storage.ReadAt(int(piece), read, 0)
+		if err != nil || n != len(read) {
+			t.Fatalf("reading piece %d: n=%d err=%v", piece, n, err)
+		}
+		if !bytes.Equal(read, pieceData) {
+			t.Fatalf("piece %d reads back %v, want %v", piece, read, pieceData)
+		}
+	}
+
+	for i, fileData := range filesMap.filesData {
+		// Nothing is ever written to them, scaffolding creates them
+		if fileData.fileSize == 0 {
+			continue
+		}
+		path := fileData.filePath
+		if !fileData.created {
+			path = filesMap.partFilePath
+		}
+		want := data[fileData.offsetStart:fileData.offsetEnd]
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fileData.created {
+			got = got[fileData.offsetStart:fileData.offsetEnd]
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("file %d holds %v, want %v", i, got, want)
+		}
+	}
+}
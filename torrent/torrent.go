@@ -0,0 +1,401 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+)
+
+// Torrent states
+const (
+	StateNew       = "new"
+	StateRunning   = "running"
+	StatePaused    = "paused"
+	StateCompleted = "completed"
+	StateStopped   = "stopped"
+)
+
+// Returned when using a torrent that was stopped
+var ErrTorrentStopped = errors.New("torrent stopped")
+
+// Torrent is a handle on one torrent of a Client: it starts, pauses and
+// stops it, and lets code use its content while it's still downloading.
+// Its methods are safe for concurrent use.
+type Torrent struct {
+	manager *TorrentManager
+
+	state string
+	// Start's context, Resume runs under it again
+	parent context.Context
+	// the current run's, peers connecting to us listen under it
+	ctx    context.Context
+	cancel context.CancelFunc
+	// the go routines of the current run
+	running sync.WaitGroup
+	// set by the download go routine, read once it's done
+	completed bool
+	// closed by Stop
+	stopped chan struct{}
+	readers map[*Reader]struct{}
+	mu      sync.Mutex
+}
+
+// Start connects to peers and downloads until the torrent completes, ctx is
+// done or Pause/Stop is called. It returns right away, use Wait to wait
+// for the download. Client starts the torrents added to it.
+func (t *Torrent) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch t.state {
+	case StateStopped:
+		return ErrTorrentStopped
+	case "", StateNew:
+	default:
+		return fmt.Errorf("torrent already started")
+	}
+
+	t.parent = ctx
+	t.run()
+	return nil
+}
+
+// run starts every go routine of the torrent under a context of its own.
+// Caller holds t.mu
+func (t *Torrent) run() {
+	ctx, cancel := context.WithCancel(t.parent)
+	t.ctx = ctx
+	t.cancel = cancel
+	t.completed = false
+	// already complete runs are completed from the start
+	wasComplete := t.isComplete()
+	t.setState(StateRunning)
+
+	tm := t.manager
+	if tm.TrackerManager != nil {
+		tm.mu.Lock()
+		downloaded := tm.downloaded
+		tm.mu.Unlock()
+		left := tm.bytesLeft()
+
+		t.running.Add(1)
+		go func() {
+			defer t.running.Done()
+			tm.TrackerManager.AskForPeers(ctx, downloaded, left)
+		}()
+	}
+	t.running.Add(3)
+	go func() {
+		defer t.running.Done()
+		tm.PeerManager.FindIdlePeers(ctx)
+	}()
+	go func() {
+		defer t.running.Done()
+		tm.PeerManager.ReadBlockRequestBus(ctx)
+	}()
+	go func() {
+		defer t.running.Done()
+		completed, err := tm.Download(ctx)
+		if err != nil && ctx.Err() == nil {
+			tm.log().Error("download failed", "err", err)
+		}
+		t.completed = completed
+		// State says completed from now on, can't take t.mu here to
+		// tell through setState: pause holds it waiting for us
+		if completed && !wasComplete && !tm.Seed {
+			tm.publish(StateChanged{InfoHash: tm.infoHash(), From: StateRunning, To: StateCompleted})
+		}
+		// Nothing left to do for peers
+		cancel()
+	}()
+}
+
+// acceptPeer hands a peer that connected to us (and asked for this
+// torrent in its handshake) to the current run. It's dropped when the
+// torrent isn't running.
+func (t *Torrent) acceptPeer(conn net.Conn, remotePeerID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	trackerManager := t.manager.TrackerManager
+	if t.state != StateRunning || t.ctx.Err() != nil || trackerManager == nil {
+		conn.Close()
+		return
+	}
+
+	ctx := t.ctx
+	t.running.Add(1)
+	go func() {
+		defer t.running.Done()
+		trackerManager.acceptPeer(ctx, conn, remotePeerID)
+	}()
+}
+
+// InfoHash identifies the torrent, hex encoded
+func (t *Torrent) InfoHash() string {
+	return t.manager.DiskManager.TorrentFileInfo.InfoHash
+}
+
+// Name is the torrent's suggested name, the file name for single file
+// torrents and the directory name otherwise
+func (t *Torrent) Name() string {
+	name, _ := t.manager.DiskManager.TorrentFileInfo.Info["name"].(string)
+	return name
+}
+
+// SetFilePriority changes a file's priority while the torrent runs, see
+// TorrentManager.SetFilePriority
+func (t *Torrent) SetFilePriority(index int, priority Priority) error {
+	return t.manager.SetFilePriority(index, priority)
+}
+
+// pause cancels the current run and waits for everything it started.
+// Caller holds t.mu
+func (t *Torrent) pause() {
+	if t.cancel == nil {
+		return
+	}
+	t.cancel()
+	t.running.Wait()
+	t.cancel = nil
+
+	// Their connections are closed, they're connected again on Resume
+	t.manager.PeerManager.RemoveAllPeers()
+}
+
+// Pause disconnects from every peer and stops downloading. Blocks that
+// were in flight are requested again after Resume, readers keep waiting.
+func (t *Torrent) Pause() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch t.state {
+	case StateStopped:
+		return ErrTorrentStopped
+	case StateRunning:
+	default:
+		return nil
+	}
+
+	t.pause()
+	if t.completed {
+		t.setState(StateCompleted)
+	} else {
+		t.setState(StatePaused)
+	}
+	t.manager.log().Info("torrent paused")
+	return nil
+}
+
+// Resume starts a paused torrent again
+func (t *Torrent) Resume() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch t.state {
+	case StateStopped:
+		return ErrTorrentStopped
+	case StatePaused:
+	default:
+		return nil
+	}
+
+	t.run()
+	t.manager.log().Info("torrent resumed")
+	return nil
+}
+
+// Stop shuts the torrent down for good: peers are disconnected, pending
+// reads fail, buffered blocks are written out and storage is closed,
+// resume data is saved and trackers are told we're gone.
+func (t *Torrent) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state == StateStopped {
+		return nil
+	}
+	t.pause()
+	t.setState(StateStopped)
+	close(t.stoppedChan())
+
+	for reader := range t.readers {
+		reader.close()
+	}
+	t.readers = nil
+
+	tm := t.manager
+	err := tm.DiskManager.Close()
+	if err != nil {
+		err = fmt.Errorf("closing storage: %w", err)
+	}
+	saveErr := tm.SaveResumeData()
+	if err == nil && saveErr != nil {
+		err = fmt.Errorf("saving resume data: %w", saveErr)
+	}
+
+	// Trackers only heard of us if we ever started
+	if tm.TrackerManager != nil && t.parent != nil {
+		tm.mu.Lock()
+		downloaded := tm.downloaded
+		tm.mu.Unlock()
+
+		// still send it when Start's context is what got us stopped
+		ctx := context.WithoutCancel(t.parent)
+		tm.TrackerManager.Announce(ctx, "stopped", downloaded, tm.bytesLeft())
+	}
+
+	t.manager.log().Info("torrent stopped")
+	return err
+}
+
+// State is one of the State* constants. A torrent that completed while
+// running is completed, unless it's seeding.
+func (t *Torrent) State() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.currentState()
+}
+
+// currentState is State for callers holding t.mu
+func (t *Torrent) currentState() string {
+	if t.state == "" {
+		return StateNew
+	}
+	if t.state == StateRunning && !t.manager.Seed && t.isComplete() {
+		return StateCompleted
+	}
+	return t.state
+}
+
+// setState moves to a new state and tells subscribers when that changes
+// what State says. Caller holds t.mu
+func (t *Torrent) setState(state string) {
+	from := t.currentState()
+	t.state = state
+	to := t.currentState()
+	if from != to {
+		t.manager.publish(StateChanged{InfoHash: t.InfoHash(), From: from, To: to})
+	}
+}
+
+// Subscribe returns a subscription to this torrent's events, see
+// Client.Subscribe
+func (t *Torrent) Subscribe(buffer int) *Subscription {
+	return t.manager.events.subscribe(t.InfoHash(), buffer)
+}
+
+// Wait blocks until every wanted piece is downloaded. It fails when ctx is
+// done first or the torrent is stopped before completing.
+func (t *Torrent) Wait(ctx context.Context) error {
+	t.mu.Lock()
+	stopped := t.stoppedChan()
+	t.mu.Unlock()
+
+	select {
+	case <-t.manager.Completed():
+		return nil
+	case <-stopped:
+		if t.isComplete() {
+			return nil
+		}
+		return ErrTorrentStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stoppedChan makes the stopped channel on first use. Caller holds t.mu
+func (t *Torrent) stoppedChan() chan struct{} {
+	if t.stopped == nil {
+		t.stopped = make(chan struct{})
+	}
+	return t.stopped
+}
+
+func (t *Torrent) isComplete() bool {
+	select {
+	case <-t.manager.Completed():
+		return true
+	default:
+		return false
+	}
+}
+
+// NewReader returns a reader over a file (index in the torrent's files
+// list, 0 for single file torrents). Reads block until the pieces they
+// need are downloaded and verified, and get those pieces requested first.
+// Files have to be scaffolded before.
+func (t *Torrent) NewReader(file int) (*Reader, error) {
+	offset, length, err := t.manager.DiskManager.fileRange(file)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == StateStopped {
+		return nil, ErrTorrentStopped
+	}
+
+	reader := &Reader{
+		Readahead: defaultReadahead,
+		tm:        t.manager,
+		torrent:   t,
+		offset:    offset,
+		length:    length,
+		raised:    make(map[int]bool),
+		done:      make(chan struct{}),
+	}
+	if t.readers == nil {
+		t.readers = make(map[*Reader]struct{})
+	}
+	t.readers[reader] = struct{}{}
+	return reader, nil
+}
+
+// forgetReader is called by closed readers
+func (t *Torrent) forgetReader(reader *Reader) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.readers, reader)
+}
+
+// File is one file of the torrent
+type File struct {
+	Index  int
+	Path   string // relative to the save path, forward slashes
+	Length int64
+}
+
+// Files lists the torrent's files in torrent order. Files have to be
+// scaffolded before.
+func (t *Torrent) Files() []File {
+	diskManager := t.manager.DiskManager
+	if diskManager.filesMap == nil {
+		return nil
+	}
+	diskManager.filesMap.mu.RLock()
+	defer diskManager.filesMap.mu.RUnlock()
+
+	files := make([]File, len(diskManager.filesMap.filesData))
+	for i, fileData := range diskManager.filesMap.filesData {
+		path, err := filepath.Rel(diskManager.savePath(), fileData.finalPath)
+		if err != nil {
+			path = filepath.Base(fileData.finalPath)
+		}
+		files[i] = File{Index: i, Path: filepath.ToSlash(path), Length: fileData.fileSize}
+	}
+	return files
+}
+
+// Move moves the torrent's data to a new save path while it keeps running,
+// see DiskManager.Move
+func (t *Torrent) Move(newSavePath string) error {
+	return t.manager.Move(newSavePath)
+}
@@ -1,148 +1,394 @@
 package torrent
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
 
-type BlockRequest struct {
+type blockRequest struct {
 	peer  *Peer
 	block *Block
 }
 
-type BlockResponse struct {
+type blockResponse struct {
+	peer       *Peer // peer that sent the block
 	pieceIndex uint
 	blockIndex uint
 	blockData  []byte
 }
 
-type BlockWritten struct {
+type blockWritten struct {
 	pieceIndex uint
 	blockIndex uint
 	success    bool
 	err        error
 }
 
-type BlockRequestBus struct {
-	BlockRequest chan *BlockRequest
+type blockRequestBus struct {
+	requests chan *blockRequest
 }
 
-type BlockRequestResponseBus struct {
-	BlockResponse chan *BlockResponse
+type blockRequestResponseBus struct {
+	responses chan *blockResponse
 }
 
-type BlockWrittenBus struct {
-	BlockWritten chan *BlockWritten
+type blockWrittenBus struct {
+	written chan *blockWritten
+}
+
+// droppedRequestBus carries peers whose outstanding request won't be
+// answered, they choked us or disconnected
+type droppedRequestBus struct {
+	peers chan *Peer
 }
 
 type TorrentManager struct {
 	TorrentFilePath         string
 	PeerManager             *PeerManager
 	PieceManager            *PieceManager
-	BlockRequestBus         *BlockRequestBus
-	BlockRequestResponseBus *BlockRequestResponseBus
-	BlockWrittenBus         *BlockWrittenBus
+	blockRequestBus         *blockRequestBus
+	blockRequestResponseBus *blockRequestResponseBus
+	blockWrittenBus         *blockWrittenBus
 	DiskManager             *DiskManager
+	PiecePicker             PiecePicker
+	// Where peers come from and who's told about the download completing
+	// or stopping, optional
+	TrackerManager *TrackerManager
+	// Keep Download running once everything is in instead of returning.
+	// Only keeps peers connected for now, we don't upload yet.
+	Seed bool
+	// block -> peers it has been requested from. Outside endgame the slice
+	// has a single peer. Only touched from the event loop.
+	inFlight map[*Block][]*Peer
+	endgame  bool
+	// piece -> number of readers waiting for it, requested before anything
+	// the picker comes up with
+	readerPieces map[int]int
+	// stats persisted in resume data
+	downloaded    int64
+	activeSeconds int64
+	startedAt     time.Time
+	// closed once every wanted piece is downloaded
+	completed     chan struct{}
+	completedOnce sync.Once
+	// resumed pieces are checked against the disk on the first run only,
+	// files created by it didn't exist before but hold what it downloaded
+	checkResumedOnce sync.Once
+	// blocks handed to the writers we haven't heard back about, and
+	// handleBlockWritten calls still running. Download waits for both
+	// before returning so nothing is left behind. pendingWrites is only
+	// touched from the event loop.
+	pendingWrites int
+	handlers      sync.WaitGroup
+	// Nothing is logged when nil
+	Logger *slog.Logger
+	// where what happens is published, nil when not run by a Client
+	events *eventBus
+	mu     sync.Mutex
 }
 
-func (tm *TorrentManager) Download() (bool, error) {
+// Download runs the event loop until every wanted piece is in (returns
+// true) or ctx is done (returns ctx's error). Before returning it waits for
+// blocks already handed to disk manager and puts requests that won't be
+// answered back to pending, so it can be called again to resume.
+func (tm *TorrentManager) Download(ctx context.Context) (bool, error) {
 
 	// go routine to track Download
-	// go routing to intercept Blocks from BlockRequestBus
+	// go routing to intercept Blocks from blockRequestBus
+
+	tm.applyFilePriorities()
+	tm.checkResumedOnce.Do(tm.dropMissingResumedData)
+
+	// Files finished in a previous run (or by a recheck) but not moved yet
+	err := tm.DiskManager.CompleteFiles(tm.PieceManager.Bitfield())
+	if err != nil {
+		tm.log().Error("failed to move completed file", "err", err)
+		tm.publish(StorageError{InfoHash: tm.infoHash(), Piece: -1, Err: err})
+	}
+
+	tm.mu.Lock()
+	tm.startedAt = time.Now()
+	tm.mu.Unlock()
+	defer tm.stopDownload()
+
+	resumeTicker := time.NewTicker(resumeSaveInterval)
+	defer resumeTicker.Stop()
+
+	// Resume data (or a recheck) may say we're done already. Trackers are
+	// only told about completing when it happens while we run (BEP 3), not
+	// again on every Resume or restart.
+	tm.checkCompleted()
+	completed := tm.Completed()
+	completedBefore := false
+	select {
+	case <-completed:
+		completedBefore = true
+	default:
+	}
 
 	// event loop
 	for {
 		select {
-		case peer := <-tm.PeerManager.IdlePeerBus.Peer:
+		case peer := <-tm.PeerManager.idlePeerBus.peers:
+			if !peer.dequeued() {
+				continue
+			}
 			block := tm.blockToBeRequested(peer)
+			if block == nil {
+				block = tm.endgameBlock(peer)
+			}
 
-			if block != nil {
-				fmt.Printf(" Requesting block (piece=%d, block=%d) from peer %s\n",
-					block.pieceIndex, block.blockIndex, peer.Ip)
-				blockRequest := &BlockRequest{
+			// The peer stays idle without a block, its next bitfield, have
+			// or wakeIdlePeers brings it back
+			if block != nil && peer.activate(block) {
+				tm.log().Debug("requesting block",
+					"piece", block.pieceIndex, "block", block.blockIndex, "peer", peer.Addr())
+				tm.markInFlight(block, peer)
+				request := &blockRequest{
 					block: block,
 					peer:  peer,
 				}
 
-				tm.PeerManager.BlockRequestBus.BlockRequest <- blockRequest
-			} else {
-				fmt.Printf(" No block to request from peer %s (bitfield empty or no pending pieces)\n", peer.Ip)
+				select {
+				case tm.PeerManager.blockRequestBus.requests <- request:
+				case <-ctx.Done():
+					// put back by stopDownload with the rest in flight
+				}
+			} else if block == nil {
+				tm.log().Debug("no block to request from peer (bitfield empty or no pending pieces)", "peer", peer.Addr())
 			}
-		case blockResponse := <-tm.PeerManager.BlockRequestResponseBus.BlockResponse:
-			fmt.Printf(" Received block response (piece=%d, block=%d) - sending to disk\n",
-				blockResponse.pieceIndex, blockResponse.blockIndex)
-			go tm.DiskManager.saveBlock(blockResponse)
-		case blockWritten := <-tm.BlockWrittenBus.BlockWritten:
-			if blockWritten.success {
-				fmt.Printf(" Block written to disk (piece=%d, block=%d)\n",
-					blockWritten.pieceIndex, blockWritten.blockIndex)
-			} else {
-				fmt.Printf(" Failed to write block (piece=%d, block=%d): %v\n",
-					blockWritten.pieceIndex, blockWritten.blockIndex, blockWritten.err)
+		case response := <-tm.PeerManager.blockRequestResponseBus.responses:
+			if !tm.acceptBlockResponse(response) {
+				continue
+			}
+			tm.log().Debug("received block, sending it to disk",
+				"piece", response.pieceIndex, "block", response.blockIndex)
+			tm.queueWrite(ctx, response)
+		case written := <-tm.blockWrittenBus.written:
+			tm.onBlockWritten(written)
+		case peer := <-tm.PeerManager.droppedRequestBus.peers:
+			tm.dropRequests(peer)
+		case <-resumeTicker.C:
+			err := tm.SaveResumeData()
+			if err != nil {
+				tm.log().Warn("failed to save resume data", "err", err)
 			}
-			go tm.handleBlockWritten(blockWritten)
+		case <-completed:
+			tm.finishDownload(ctx, !completedBefore)
+			if !tm.Seed {
+				return true, nil
+			}
+			tm.log().Info("seeding")
+			// A closed channel is always ready, stop selecting on it
+			completed = nil
+		case <-ctx.Done():
+			return false, ctx.Err()
 		}
 	}
-
-	return true, nil
 }
 
-// Modern RAM bandwidth: ~20–50 GB/s
-func (tm *TorrentManager) blockToBeRequested(peer *Peer) *Block {
-	bitfield := peer.bitfield
+// Completed returns a channel closed once every wanted piece is downloaded
+func (tm *TorrentManager) Completed() <-chan struct{} {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
 
-	// Check if peer has sent bitfield yet
-	if bitfield == nil || len(bitfield) == 0 {
-		fmt.Printf(" Peer %s has no bitfield yet\n", peer.Ip)
-		return nil
+	if tm.completed == nil {
+		tm.completed = make(chan struct{})
 	}
+	return tm.completed
+}
 
-	pendingPieces := tm.PieceManager.PendingPieces()
-	fmt.Printf(" Checking %d pending pieces against peer %s bitfield\n", len(pendingPieces), peer.Ip)
+// stopDownload waits for the writes and piece checks Download started and
+// puts blocks that were requested but not received back to pending
+func (tm *TorrentManager) stopDownload() {
+	for tm.pendingWrites > 0 {
+		tm.onBlockWritten(<-tm.blockWrittenBus.written)
+	}
+	tm.handlers.Wait()
 
-	var selectedBlock *Block
-	for index, piece := range pendingPieces {
-		// Check if peer has this piece in their bitfield
-		// Bitfield is a byte array where each bit represents a piece
-		byteIndex := index / 8
-		bitIndex := uint(index % 8)
-
-		// Check if we have enough bytes in bitfield
-		if byteIndex >= len(bitfield) {
-			continue
+	tm.mu.Lock()
+	for block := range tm.inFlight {
+		block.mu.Lock()
+		if block.status == "downloading" {
+			block.status = "pending"
 		}
+		block.mu.Unlock()
+	}
+	tm.inFlight = nil
+	tm.endgame = false
+	// Time paused doesn't count as active
+	if !tm.startedAt.IsZero() {
+		tm.activeSeconds += int64(time.Since(tm.startedAt).Seconds())
+		tm.startedAt = time.Time{}
+	}
+	tm.mu.Unlock()
 
-		// Check if the bit is set (peer has this piece)
-		hasPiece := (bitfield[byteIndex] & (1 << (7 - bitIndex))) != 0
-		if !hasPiece {
+	err := tm.SaveResumeData()
+	if err != nil {
+		tm.log().Warn("failed to save resume data", "err", err)
+	}
+}
+
+// bytesLeft is what's still to download of the wanted pieces
+func (tm *TorrentManager) bytesLeft() int64 {
+	var left int64
+	for index := 0; index < int(tm.PieceManager.TotalPieces); index++ {
+		if tm.PieceManager.isDownloaded(index) || tm.PieceManager.PiecePriority(index) == PrioritySkip {
 			continue
 		}
+		left += tm.DiskManager.pieceLength(index)
+	}
+	return left
+}
 
-		// Find a pending block in this piece
-		for _, pieceBlock := range piece.blocks {
-			if pieceBlock.status == "pending" {
-				selectedBlock = pieceBlock
-				break
-			}
-		}
+// checkCompleted signals the event loop once every piece we want (all but
+// skipped ones) is downloaded
+func (tm *TorrentManager) checkCompleted() {
+	if len(tm.PieceManager.Downloaded()) < tm.PieceManager.WantedPieces() {
+		return
+	}
+	tm.Completed() // makes sure the channel exists
+	tm.completedOnce.Do(func() {
+		close(tm.completed)
+		tm.publish(TorrentCompleted{InfoHash: tm.infoHash()})
+	})
+}
 
-		// If we found a block, return it
-		if selectedBlock != nil {
-			break
+func (tm *TorrentManager) log() *slog.Logger {
+	return loggerOr(tm.Logger)
+}
+
+func (tm *TorrentManager) infoHash() string {
+	return tm.DiskManager.TorrentFileInfo.InfoHash
+}
+
+// publish sends an event to the client's subscribers
+func (tm *TorrentManager) publish(event Event) {
+	tm.events.publish(tm.infoHash(), event)
+}
+
+// finishDownload makes sure everything is on disk, saves resume data and
+// tells the trackers we're done when announce is set
+func (tm *TorrentManager) finishDownload(ctx context.Context, announce bool) {
+	tm.log().Info("download complete")
+
+	err := tm.DiskManager.Flush()
+	if err == nil {
+		err = tm.DiskManager.Sync()
+	}
+	if err != nil {
+		tm.log().Error("failed to flush data to disk", "err", err)
+		tm.publish(StorageError{InfoHash: tm.infoHash(), Piece: -1, Err: err})
+	}
+
+	err = tm.SaveResumeData()
+	if err != nil {
+		tm.log().Warn("failed to save resume data", "err", err)
+	}
+
+	if announce && tm.TrackerManager != nil {
+		tm.mu.Lock()
+		downloaded := tm.downloaded
+		tm.mu.Unlock()
+		tm.TrackerManager.Announce(ctx, "completed", downloaded, 0)
+	}
+}
+
+// queueWrite hands a block to disk manager's writers. When the queue is
+// full we wait, which slows peers down instead of piling blocks up in
+// memory, but keep taking write results meanwhile: the writers are blocked
+// on handing those to us.
+func (tm *TorrentManager) queueWrite(ctx context.Context, response *blockResponse) {
+	for {
+		select {
+		case tm.DiskManager.writeQueue <- response:
+			tm.pendingWrites++
+			return
+		case written := <-tm.blockWrittenBus.written:
+			tm.onBlockWritten(written)
+		case <-ctx.Done():
+			// Dropped, it's no longer in flight so put it back here
+			piece := tm.PieceManager.GetPiece(int(response.pieceIndex))
+			block := piece.blocks[response.blockIndex]
+			block.mu.Lock()
+			block.status = "pending"
+			block.mu.Unlock()
+			return
 		}
 	}
-	return selectedBlock
 }
 
-func (tm *TorrentManager) handleBlockWritten(event *BlockWritten) {
+func (tm *TorrentManager) onBlockWritten(written *blockWritten) {
+	if written.success {
+		tm.log().Debug("block written to disk",
+			"piece", written.pieceIndex, "block", written.blockIndex)
+	} else {
+		tm.log().Error("failed to write block",
+			"piece", written.pieceIndex, "block", written.blockIndex, "err", written.err)
+		tm.publish(StorageError{InfoHash: tm.infoHash(), Piece: int(written.pieceIndex), Err: written.err})
+	}
+	tm.pendingWrites--
+	tm.handlers.Add(1)
+	go func() {
+		defer tm.handlers.Done()
+		tm.handleBlockWritten(written)
+	}()
+}
+
+// blockToBeRequested asks the torrent's piece picker for the next block.
+// Rarest first is used when no picker was configured.
+func (tm *TorrentManager) blockToBeRequested(peer *Peer) *Block {
+	bitfield := peer.bitfieldCopy()
+
+	// Check if peer has sent bitfield yet
+	if bitfield == nil || len(bitfield) == 0 {
+		tm.log().Debug("peer has no bitfield yet", "peer", peer.Addr())
+		return nil
+	}
+
+	// Somebody is blocked reading these right now
+	if block := tm.readerBlock(peer); block != nil {
+		return block
+	}
+
+	if tm.PiecePicker == nil {
+		tm.PiecePicker = &RarestFirstPicker{}
+	}
+
+	var blocks []*Block
+	if picker, ok := tm.PiecePicker.(PeerPiecePicker); ok {
+		blocks = picker.PickBlocksForPeer(peer, tm.PeerManager, tm.PieceManager, 1)
+	} else {
+		blocks = tm.PiecePicker.PickBlocks(bitfield, tm.PieceManager, 1)
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+	return blocks[0]
+}
+
+func (tm *TorrentManager) handleBlockWritten(event *blockWritten) {
 	piece := tm.PieceManager.GetPiece(int(event.pieceIndex))
 	if piece == nil {
 		return
 	}
 
-	// Update block status
+	// Update block status. A failed write puts the block back in the
+	// pending pool so some peer requests it again.
 	piece.mu.Lock()
 	if int(event.blockIndex) < len(piece.blocks) {
 		block := piece.blocks[event.blockIndex]
 		block.mu.Lock()
-		block.status = "downloaded"
+		if event.success {
+			block.status = "downloaded"
+		} else {
+			block.status = "pending"
+		}
 		block.mu.Unlock()
 	}
 
@@ -158,19 +404,296 @@ func (tm *TorrentManager) handleBlockWritten(event *BlockWritten) {
 			break
 		}
 	}
+	// Last two blocks can be written at the same time, one of us verifies
+	if allDownloaded && piece.finishing {
+		allDownloaded = false
+	}
+	if allDownloaded {
+		piece.finishing = true
+	}
 	piece.mu.Unlock()
 
-	// If all blocks downloaded, move piece to downloaded state
+	if event.success && int(event.blockIndex) < len(piece.blocks) {
+		tm.mu.Lock()
+		tm.downloaded += int64(piece.blocks[event.blockIndex].length)
+		tm.mu.Unlock()
+	}
+
+	// If all blocks downloaded, hash the piece (and write it out if it was
+	// buffered) then move it to downloaded state. A bad piece starts over.
 	if allDownloaded {
-		err := tm.PieceManager.MovePieceToDownloaded(int(event.pieceIndex))
+		err := tm.DiskManager.FinishPiece(int(event.pieceIndex))
+		if err != nil {
+			tm.log().Warn("piece failed verification, downloading it again",
+				"piece", event.pieceIndex, "err", err)
+			if errors.Is(err, errHashMismatch) {
+				tm.publish(PieceHashFailed{InfoHash: tm.infoHash(), Piece: int(event.pieceIndex), Err: err})
+			} else {
+				tm.publish(StorageError{InfoHash: tm.infoHash(), Piece: int(event.pieceIndex), Err: err})
+			}
+			tm.PieceManager.ResetPiece(int(event.pieceIndex))
+			tm.PeerManager.wakeIdlePeers()
+			return
+		}
+
+		err = tm.PieceManager.MovePieceToDownloaded(int(event.pieceIndex))
 		if err == nil {
-			fmt.Printf(" PIECE %d COMPLETED! Moving to downloaded state\n", event.pieceIndex)
+			err = tm.DiskManager.MarkComplete(int(event.pieceIndex))
+			if err != nil {
+				tm.log().Error("storage failed to complete piece", "piece", event.pieceIndex, "err", err)
+				tm.publish(StorageError{InfoHash: tm.infoHash(), Piece: int(event.pieceIndex), Err: err})
+			}
+
+			err = tm.DiskManager.CompleteFiles(tm.PieceManager.Bitfield())
+			if err != nil {
+				tm.log().Error("failed to move completed file", "err", err)
+				tm.publish(StorageError{InfoHash: tm.infoHash(), Piece: -1, Err: err})
+			}
 
-			// Calculate and display progress
 			downloaded := len(tm.PieceManager.Downloaded())
-			total := int(tm.PieceManager.TotalPieces)
-			percentage := float64(downloaded) / float64(total) * 100
-			fmt.Printf(" Progress: %d/%d pieces (%.2f%%)\n", downloaded, total, percentage)
+			total := tm.PieceManager.WantedPieces()
+			tm.log().Debug("piece verified", "piece", event.pieceIndex, "done", downloaded, "wanted", total)
+			tm.publish(PieceCompleted{InfoHash: tm.infoHash(), Piece: int(event.pieceIndex), Done: downloaded, Wanted: total})
+
+			tm.checkCompleted()
+		}
+	}
+}
+
+// SetFilePriority changes a file's priority, can be called while downloading.
+// Pieces only belonging to skipped files stop being requested.
+func (tm *TorrentManager) SetFilePriority(index int, priority Priority) error {
+	err := tm.DiskManager.SetFilePriority(index, priority)
+	if err != nil {
+		return err
+	}
+	tm.applyFilePriorities()
+	// Skipping the files still missing finishes the download
+	tm.checkCompleted()
+	return nil
+}
+
+// applyFilePriorities gives every piece the priority of the most important
+// file it overlaps
+func (tm *TorrentManager) applyFilePriorities() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	for index := 0; index < int(tm.PieceManager.TotalPieces); index++ {
+		// Pieces a reader is waiting for stay high until it's done
+		if tm.readerPieces[index] > 0 {
+			continue
+		}
+		tm.PieceManager.SetPiecePriority(index, tm.DiskManager.pieceFilePriority(index))
+	}
+	// Newly wanted pieces may be work for peers that had none
+	defer tm.PeerManager.wakeIdlePeers()
+}
+
+// markInFlight records that block was requested from peer
+func (tm *TorrentManager) markInFlight(block *Block, peer *Peer) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if tm.inFlight == nil {
+		tm.inFlight = make(map[*Block][]*Peer)
+	}
+
+	block.mu.Lock()
+	block.status = "downloading"
+	block.mu.Unlock()
+
+	tm.inFlight[block] = append(tm.inFlight[block], peer)
+}
+
+// endgameBlock is consulted when there is no pending block left for the
+// peer. Once every remaining block is in flight we stop waiting on a single
+// (possibly slow or dead) peer per block and ask everyone who has the piece.
+// Picks the in-flight block with the fewest requesters that this peer
+// hasn't been asked for yet.
+func (tm *TorrentManager) endgameBlock(peer *Peer) *Block {
+	if tm.hasPendingBlocks() {
+		return nil
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if len(tm.inFlight) == 0 {
+		return nil
+	}
+
+	if !tm.endgame {
+		tm.endgame = true
+		tm.log().Info("entering endgame mode", "in_flight", len(tm.inFlight))
+		// Peers that had nothing left to do can double up on requests now
+		defer tm.PeerManager.wakeIdlePeers()
+	}
+
+	var selectedBlock *Block
+	for block, peers := range tm.inFlight {
+		if !peer.hasPiece(int(block.pieceIndex)) || containsPeer(peers, peer) {
+			continue
+		}
+		if selectedBlock == nil || len(peers) < len(tm.inFlight[selectedBlock]) {
+			selectedBlock = block
+		}
+	}
+	return selectedBlock
+}
+
+// hasPendingBlocks reports whether any block is still waiting to be requested
+func (tm *TorrentManager) hasPendingBlocks() bool {
+	for _, piece := range tm.PieceManager.PendingPieces() {
+		for _, block := range piece.blocks {
+			block.mu.Lock()
+			pending := block.status == "pending"
+			block.mu.Unlock()
+			if pending {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptBlockResponse drops duplicates (endgame makes them expected) before
+// they reach disk manager and cancels the request on every other peer we
+// asked for the same block.
+func (tm *TorrentManager) acceptBlockResponse(response *blockResponse) bool {
+	piece := tm.PieceManager.GetPiece(int(response.pieceIndex))
+	if piece == nil || int(response.blockIndex) >= len(piece.blocks) {
+		return false
+	}
+	block := piece.blocks[response.blockIndex]
+
+	tm.mu.Lock()
+	peers, ok := tm.inFlight[block]
+	delete(tm.inFlight, block)
+	tm.mu.Unlock()
+
+	if !ok {
+		tm.log().Debug("ignoring duplicate block",
+			"piece", response.pieceIndex, "block", response.blockIndex)
+		return false
+	}
+
+	for _, peer := range peers {
+		if peer == response.peer {
+			continue
+		}
+		err := peer.CancelBlock(block)
+		if err != nil {
+			tm.log().Debug("failed to send cancel", "peer", peer.Addr(), "err", err)
+		}
+		// Peer won't answer a cancelled request, free it up for more work
+		peer.requestDone(block.pieceIndex, block.blockIndex)
+	}
+	return true
+}
+
+// dropRequests forgets what was asked from a peer that choked us or went
+// away. Blocks nobody else was asked for go back to pending and idle peers
+// are woken up to take them.
+func (tm *TorrentManager) dropRequests(peer *Peer) {
+	tm.mu.Lock()
+	dropped := 0
+	for block, peers := range tm.inFlight {
+		i := slices.Index(peers, peer)
+		if i < 0 {
+			continue
+		}
+		dropped++
+		peers = slices.Delete(peers, i, i+1)
+		if len(peers) > 0 {
+			tm.inFlight[block] = peers
+			continue
+		}
+		delete(tm.inFlight, block)
+		block.mu.Lock()
+		if block.status == "downloading" {
+			block.status = "pending"
+		}
+		block.mu.Unlock()
+	}
+	tm.mu.Unlock()
+
+	if dropped == 0 {
+		return
+	}
+	tm.log().Debug("dropped requests", "peer", peer.Addr(), "blocks", dropped)
+	tm.PeerManager.wakeIdlePeers()
+}
+
+func containsPeer(peers []*Peer, peer *Peer) bool {
+	for _, p := range peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// raiseReaderPieces marks pieces as needed by a reader. They're bumped to
+// high priority (un-skipping them if their file is skipped) and requested
+// ahead of whatever the picker wants.
+func (tm *TorrentManager) raiseReaderPieces(indexes []int) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if tm.readerPieces == nil {
+		tm.readerPieces = make(map[int]int)
+	}
+	for _, index := range indexes {
+		tm.readerPieces[index]++
+		if tm.readerPieces[index] == 1 {
+			tm.PieceManager.SetPiecePriority(index, PriorityHigh)
+		}
+	}
+	// Pieces of skipped files may be work for peers that had none
+	defer tm.PeerManager.wakeIdlePeers()
+}
+
+// lowerReaderPieces undoes raiseReaderPieces, pieces no reader needs any
+// more go back to the priority of their files
+func (tm *TorrentManager) lowerReaderPieces(indexes []int) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	for _, index := range indexes {
+		if tm.readerPieces[index] == 0 {
+			continue
+		}
+		tm.readerPieces[index]--
+		if tm.readerPieces[index] == 0 {
+			delete(tm.readerPieces, index)
+			tm.PieceManager.SetPiecePriority(index, tm.DiskManager.pieceFilePriority(index))
+		}
+	}
+}
+
+// readerBlock returns a block of the lowest indexed piece a reader is
+// waiting for that the peer has
+func (tm *TorrentManager) readerBlock(peer *Peer) *Block {
+	tm.mu.Lock()
+	indexes := make([]int, 0, len(tm.readerPieces))
+	for index := range tm.readerPieces {
+		indexes = append(indexes, index)
+	}
+	tm.mu.Unlock()
+
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		if !peer.hasPiece(index) {
+			continue
+		}
+		piece := tm.PieceManager.GetPiece(index)
+		if piece == nil {
+			continue
+		}
+		if block := piece.pendingBlock(); block != nil {
+			return block
 		}
 	}
+	return nil
 }
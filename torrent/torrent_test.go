@@ -0,0 +1,292 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Pieces of 16 KiB, the last one short
+const testPieceLength = 16 * 1024
+
+func TestTorrentPauseResumeStop(t *testing.T) {
+	tracker := newFakeTracker(t)
+	tfi, content := newTestTorrent(t, "file.bin", testPieceLength, []testFile{{length: 20*testPieceLength + 1000}}, tracker.URL)
+	// Half the blocks come in before pausing, the rest only after resuming
+	hold := make(chan struct{})
+	release := sync.OnceFunc(func() { close(hold) })
+	defer release()
+	seeder := newFakeSeeder(t, &tfi, content, 10, hold)
+	silent, accepted := newSilentPeer(t)
+	tracker.setPeers(seeder, silent)
+
+	baseline := runtime.NumGoroutine()
+	dir := t.TempDir()
+	client, err := NewClient(Config{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription := client.Subscribe(1024)
+
+	torrent, err := client.AddTorrentBytes(tfi.TorrentFile.Data, TorrentConfig{Seed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Paused while a handshake with the silent peer is still going on
+	waitForEvent(t, subscription, 5*time.Second, func(event Event) bool {
+		_, ok := event.(PieceCompleted)
+		return ok
+	})
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent peer wasn't contacted")
+	}
+	within(t, 2*time.Second, "Pause", func() {
+		err = torrent.Pause()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := torrent.State(); state != StatePaused {
+		t.Fatalf("state is %s after Pause, want %s", state, StatePaused)
+	}
+
+	err = torrent.Resume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = torrent.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Seeding keeps it running, pausing and resuming it again mustn't tell
+	// trackers it completed a second time
+	completedAnnounces := 0
+	startedAnnounces := 0
+	countAnnounces := func(event Event) {
+		if announced, ok := event.(TrackerAnnounced); ok {
+			switch announced.Event {
+			case "completed":
+				completedAnnounces++
+			case "started":
+				startedAnnounces++
+			}
+		}
+	}
+	waitForEvent(t, subscription, 5*time.Second, func(event Event) bool {
+		countAnnounces(event)
+		return completedAnnounces == 1
+	})
+	within(t, 2*time.Second, "Pause", func() { torrent.Pause() })
+	torrent.Resume()
+	waitForEvent(t, subscription, 5*time.Second, func(event Event) bool {
+		countAnnounces(event)
+		return startedAnnounces == 2
+	})
+
+	within(t, 2*time.Second, "Stop", func() {
+		err = torrent.Stop()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	within(t, 2*time.Second, "Close", func() { client.Close() })
+	for event := range subscription.Events() {
+		countAnnounces(event)
+	}
+	if completedAnnounces != 1 {
+		t.Fatalf("announced completed %d times, want 1", completedAnnounces)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatal("downloaded data doesn't match")
+	}
+	if downloaded := torrent.Stats().Downloaded; downloaded != int64(len(content)) {
+		t.Fatalf("downloaded %d bytes, want %d", downloaded, len(content))
+	}
+
+	// Trackers hear how far along we are: nothing yet when we first start,
+	// done when resuming after completing
+	started := tracker.startedAnnounces()
+	if len(started) != 3 {
+		t.Fatalf("announced started %d times, want 3", len(started))
+	}
+	first, last := started[0], started[2]
+	if first.Get("downloaded") != "0" || first.Get("left") != strconv.Itoa(len(content)) {
+		t.Fatalf("first started announce says downloaded %s left %s", first.Get("downloaded"), first.Get("left"))
+	}
+	if last.Get("downloaded") != strconv.Itoa(len(content)) || last.Get("left") != "0" {
+		t.Fatalf("last started announce says downloaded %s left %s", last.Get("downloaded"), last.Get("left"))
+	}
+
+	checkGoroutines(t, baseline)
+}
+
+func TestTorrentStopWithSilentPeer(t *testing.T) {
+	tracker := newFakeTracker(t)
+	tfi, _ := newTestTorrent(t, "file.bin", testPieceLength, []testFile{{length: 4 * testPieceLength}}, tracker.URL)
+	silent, accepted := newSilentPeer(t)
+	tracker.setPeers(silent)
+
+	baseline := runtime.NumGoroutine()
+	client, err := NewClient(Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := client.AddTorrentBytes(tfi.TorrentFile.Data, TorrentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent peer wasn't contacted")
+	}
+	// Well before the handshake times out
+	within(t, 2*time.Second, "Stop", func() {
+		err = torrent.Stop()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := torrent.State(); state != StateStopped {
+		t.Fatalf("state is %s after Stop, want %s", state, StateStopped)
+	}
+	if err := torrent.Resume(); err != ErrTorrentStopped {
+		t.Fatalf("Resume after Stop returned %v, want %v", err, ErrTorrentStopped)
+	}
+
+	within(t, 2*time.Second, "Close", func() { client.Close() })
+	checkGoroutines(t, baseline)
+}
+
+func TestClientCloseWhileDownloading(t *testing.T) {
+	tracker := newFakeTracker(t)
+	tfi, content := newTestTorrent(t, "file.bin", testPieceLength, []testFile{{length: 8 * testPieceLength}}, tracker.URL)
+	// Never finishes: blocks after the first 2 are held until the test ends
+	hold := make(chan struct{})
+	release := sync.OnceFunc(func() { close(hold) })
+	defer release()
+	seeder := newFakeSeeder(t, &tfi, content, 2, hold)
+	silent, _ := newSilentPeer(t)
+	tracker.setPeers(seeder, silent)
+
+	baseline := runtime.NumGoroutine()
+	client, err := NewClient(Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription := client.Subscribe(0)
+	torrent, err := client.AddTorrentBytes(tfi.TorrentFile.Data, TorrentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, subscription, 5*time.Second, func(event Event) bool {
+		_, ok := event.(PieceCompleted)
+		return ok
+	})
+
+	within(t, 2*time.Second, "Close", func() { client.Close() })
+	if state := torrent.State(); state != StateStopped {
+		t.Fatalf("state is %s after Close, want %s", state, StateStopped)
+	}
+	// The seeder is still holding a block we asked for
+	release()
+	checkGoroutines(t, baseline)
+}
+
+func TestTorrentSeederChokesMidRequest(t *testing.T) {
+	tracker := newFakeTracker(t)
+	tfi, content := newTestTorrent(t, "file.bin", testPieceLength, []testFile{{length: 4*testPieceLength + 1000}}, tracker.URL)
+	// The only seeder drops the 3rd block we ask for, it has to be asked
+	// again once we're unchoked
+	seeder := newChokingSeeder(t, &tfi, content, 3)
+	tracker.setPeers(seeder)
+
+	dir := t.TempDir()
+	client, err := NewClient(Config{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	torrent, err := client.AddTorrentBytes(tfi.TorrentFile.Data, TorrentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = torrent.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatal("downloaded data doesn't match")
+	}
+}
+
+func TestTorrentCompletesWhenSkippingTheRest(t *testing.T) {
+	tracker := newFakeTracker(t)
+	tfi, content := newTestTorrent(t, "data", testPieceLength, []testFile{
+		{path: []string{"a.bin"}, length: 2 * testPieceLength},
+		{path: []string{"b.bin"}, length: 2 * testPieceLength},
+	}, tracker.URL)
+	// The seeder's b.bin is corrupt, only a.bin ever finishes
+	seeding := bytes.Clone(content)
+	for i := 2 * testPieceLength; i < len(seeding); i++ {
+		seeding[i]++
+	}
+	tracker.setPeers(newFakeSeeder(t, &tfi, seeding, 0, nil))
+
+	client, err := NewClient(Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	subscription := client.Subscribe(64)
+	torrent, err := client.AddTorrentBytes(tfi.TorrentFile.Data, TorrentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pieces := 0
+	waitForEvent(t, subscription, 5*time.Second, func(event Event) bool {
+		if _, ok := event.(PieceCompleted); ok {
+			pieces++
+		}
+		return pieces == 2
+	})
+	err = torrent.SetFilePriority(1, PrioritySkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = torrent.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,6 +1,7 @@
 package torrent
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,17 +21,45 @@ type tracker struct {
 	Kind string
 }
 
-func (t tracker) Peers(infoHash string) ([]*Peer, error) {
+// announceRequest is what we tell the tracker about ourselves
+type announceRequest struct {
+	event      string // started, completed, stopped or empty for a regular announce
+	downloaded int64
+	left       int64
+	peerID     string
+	port       uint16 // where peers can connect to us
+}
+
+// Used when no client gave us a peer ID or a port
+const (
+	defaultPeerID = "abcde12345abcde12345"
+	defaultPort   = 6881
+)
+
+// UDP trackers want the event as a number
+var udpEvents = map[string]uint32{"": 0, "completed": 1, "started": 2, "stopped": 3}
+
+// Trackers that don't answer within this are given up on
+var trackerHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// Peers announces that we're starting and returns the peers the tracker
+// gave us
+func (t tracker) Peers(ctx context.Context, infoHash string, request announceRequest) ([]*Peer, error) {
+	request.event = "started"
+	return t.announce(ctx, infoHash, request)
+}
+
+func (t tracker) announce(ctx context.Context, infoHash string, request announceRequest) ([]*Peer, error) {
 	switch t.Kind {
 	case "http":
-		return t.httpTrackerPeers(infoHash)
+		return t.httpTrackerPeers(ctx, infoHash, request)
 	case "udp":
-		return t.udpTrackerPeers(infoHash)
+		return t.udpTrackerPeers(ctx, infoHash, request)
 	}
 	return nil, fmt.Errorf("only works for udp and http")
 }
 
-func (t tracker) httpTrackerPeers(infoHash string) ([]*Peer, error) {
+func (t tracker) httpTrackerPeers(ctx context.Context, infoHash string, request announceRequest) ([]*Peer, error) {
 	// Convert hex-encoded infohash to raw bytes
 	infoHashBytes, err := hex.DecodeString(infoHash)
 	if err != nil {
@@ -39,23 +69,22 @@ func (t tracker) httpTrackerPeers(infoHash string) ([]*Peer, error) {
 	params := url.Values{}
 	// Use raw bytes for info_hash, not the hex string
 	params.Add("info_hash", string(infoHashBytes))
-	params.Add("peer_id", "abcde12345abcde12345")
-	params.Add("port", "6883")
+	params.Add("peer_id", request.peerID)
+	params.Add("port", strconv.Itoa(int(request.port)))
 	params.Add("uploaded", "0")
-	params.Add("downloaded", "0")
-	params.Add("left", "10000")
+	params.Add("downloaded", strconv.FormatInt(request.downloaded, 10))
+	params.Add("left", strconv.FormatInt(request.left, 10))
 	params.Add("compact", "0")
-
-	// Extract hostname for display
-	parsedURL, _ := url.Parse(t.Url)
-	hostname := parsedURL.Host
-	if hostname == "" {
-		hostname = t.Url
+	if request.event != "" {
+		params.Add("event", request.event)
 	}
-	fmt.Printf(" HTTP tracker: %s", hostname)
 
 	fullURL := t.Url + "?" + params.Encode()
-	resp, err := http.Get(fullURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fullURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker URL: %v", err)
+	}
+	resp, err := trackerHTTPClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("connection failed")
 	}
@@ -98,11 +127,10 @@ func (t tracker) httpTrackerPeers(infoHash string) ([]*Peer, error) {
 				Ip:       ip,
 				port:     uint(port),
 				infoHash: string(infoHashBytes),
-				PeerId:   "abcde12345abcde12345",
+				PeerId:   request.peerID,
 			}
 			peers = append(peers, &peer)
 		}
-		fmt.Printf(" → %d peers\n", len(peers))
 		return peers, nil
 	}
 
@@ -125,7 +153,6 @@ func (t tracker) httpTrackerPeers(infoHash string) ([]*Peer, error) {
 			}
 			peers = append(peers, &peer)
 		}
-		fmt.Printf(" → %d peers\n", len(peers))
 		return peers, nil
 	}
 
@@ -133,7 +160,7 @@ func (t tracker) httpTrackerPeers(infoHash string) ([]*Peer, error) {
 }
 
 // udpTrackerPeers implements the full UDP tracker protocol
-func (t tracker) udpTrackerPeers(infoHash string) ([]*Peer, error) {
+func (t tracker) udpTrackerPeers(ctx context.Context, infoHash string, request announceRequest) ([]*Peer, error) {
 	// Convert hex-encoded infohash to raw bytes
 	infoHashBytes, err := hex.DecodeString(infoHash)
 	if err != nil {
@@ -155,14 +182,16 @@ func (t tracker) udpTrackerPeers(infoHash string) ([]*Peer, error) {
 		trackerURL = trackerURL[:idx]
 	}
 
-	fmt.Printf(" UDP tracker: %s", trackerURL)
-
 	// Step 1: Connect to tracker and get connection ID
-	conn, err := net.Dial("udp", trackerURL)
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", trackerURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to UDP tracker: %v", err)
 	}
 	defer conn.Close()
+	// Closing the socket unblocks a read that's waiting on the tracker
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
 
 	// Set read timeout to avoid hanging forever
 	conn.SetDeadline(time.Now().Add(15 * time.Second))
@@ -173,12 +202,11 @@ func (t tracker) udpTrackerPeers(infoHash string) ([]*Peer, error) {
 	}
 
 	// Step 2: Send announce request and get peers
-	peers, err := t.udpAnnounce(conn, connID, infoHashBytes)
+	peers, err := t.udpAnnounce(conn, connID, infoHashBytes, request)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Printf(" → %d peers\n", len(peers))
 	return peers, nil
 }
 
@@ -244,7 +272,7 @@ func (t tracker) udpConnect(conn net.Conn) (uint64, uint32, error) {
 // 88      32-bit integer  key
 // 92      32-bit integer  num_want        -1 // default
 // 96      16-bit integer  port
-func (t tracker) udpAnnounce(conn net.Conn, connectionID uint64, infoHashBytes []byte) ([]*Peer, error) {
+func (t tracker) udpAnnounce(conn net.Conn, connectionID uint64, infoHashBytes []byte, announce announceRequest) ([]*Peer, error) {
 	// Generate random transaction ID
 	transactionID := rand.Uint32()
 
@@ -258,20 +286,20 @@ func (t tracker) udpAnnounce(conn net.Conn, connectionID uint64, infoHashBytes [
 	copy(request[16:36], infoHashBytes)
 
 	// Peer ID (20 bytes)
-	peerID := "abcde12345abcde12345"
+	peerID := announce.peerID
 	copy(request[36:56], []byte(peerID))
 
 	// Downloaded (8 bytes)
-	binary.BigEndian.PutUint64(request[56:64], 0)
+	binary.BigEndian.PutUint64(request[56:64], uint64(announce.downloaded))
 
 	// Left (8 bytes) - amount left to download
-	binary.BigEndian.PutUint64(request[64:72], 10000000) // Arbitrary large number
+	binary.BigEndian.PutUint64(request[64:72], uint64(announce.left))
 
 	// Uploaded (8 bytes)
 	binary.BigEndian.PutUint64(request[72:80], 0)
 
 	// Event (4 bytes) - 0: none, 1: completed, 2: started, 3: stopped
-	binary.BigEndian.PutUint32(request[80:84], 2) // 2 = started
+	binary.BigEndian.PutUint32(request[80:84], udpEvents[announce.event])
 
 	// IP address (4 bytes) - 0 = default
 	binary.BigEndian.PutUint32(request[84:88], 0)
@@ -283,7 +311,7 @@ func (t tracker) udpAnnounce(conn net.Conn, connectionID uint64, infoHashBytes [
 	binary.BigEndian.PutUint32(request[92:96], 0xFFFFFFFF)
 
 	// Port (2 bytes)
-	binary.BigEndian.PutUint16(request[96:98], 6881)
+	binary.BigEndian.PutUint16(request[96:98], announce.port)
 
 	// Send announce request
 	_, err := conn.Write(request)
@@ -1,7 +1,11 @@
 package torrent
 
 import (
-	"fmt"
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"strconv"
 	"sync"
 )
 
@@ -10,29 +14,76 @@ type TrackerManager struct {
 	Infohash    string
 	Pm          *PeerManager
 	TotalPieces uint
-	mu          sync.Mutex
+	// Who we are to trackers and peers, and where peers can reach us.
+	// Defaults are used when empty.
+	PeerID string
+	Port   uint16
+	// Nothing is logged when nil
+	Logger *slog.Logger
+	// where announces and peers coming and going are published, nil when
+	// not run by a Client
+	events *eventBus
+	mu     sync.Mutex
 }
 
-func (tm *TrackerManager) AskForPeers() {
+func (tm *TrackerManager) log() *slog.Logger {
+	return loggerOr(tm.Logger)
+}
+
+// announceRequest fills in who we are
+func (tm *TrackerManager) announceRequest(event string, downloaded, left int64) announceRequest {
+	request := announceRequest{
+		event:      event,
+		downloaded: downloaded,
+		left:       left,
+		peerID:     tm.PeerID,
+		port:       tm.Port,
+	}
+	if request.peerID == "" {
+		request.peerID = defaultPeerID
+	}
+	if request.port == 0 {
+		request.port = defaultPort
+	}
+	return request
+}
+
+// AskForPeers goes through the trackers and connects to the peers they
+// give us. Trackers are told how much we have downloaded and have left.
+// It returns once ctx is done and every peer connection it opened is
+// closed.
+func (tm *TrackerManager) AskForPeers(ctx context.Context, downloaded, left int64) {
 	// Stop after getting this many unique peers
 	const maxPeers = 50
 
+	var connections sync.WaitGroup
+	defer connections.Wait()
+
 	for i, tracker := range tm.Trackers {
+		if ctx.Err() != nil {
+			return
+		}
+
 		// Check if we have enough peers
-		currentPeerCount := len(tm.Pm.Peers)
+		currentPeerCount := tm.Pm.PeerCount()
 
 		if currentPeerCount >= maxPeers {
-			fmt.Printf("\n Got %d peers, skipping remaining %d trackers\n\n",
-				currentPeerCount, len(tm.Trackers)-i)
+			tm.log().Info("got enough peers, skipping remaining trackers",
+				"peers", currentPeerCount, "skipped", len(tm.Trackers)-i)
 			break
 		}
 
 		// There should be a timeout here
-		peers, err := tracker.Peers(tm.Infohash)
+		peers, err := tracker.Peers(ctx, tm.Infohash, tm.announceRequest("started", downloaded, left))
 		if err != nil {
-			fmt.Printf(" %v\n", err)
+			if ctx.Err() == nil {
+				tm.log().Warn("announce failed", "tracker", tracker.Url, "event", "started", "err", err)
+				tm.events.publish(tm.Infohash, TrackerError{InfoHash: tm.Infohash, Tracker: tracker.Url, Event: "started", Err: err})
+			}
 			continue
 		}
+		tm.log().Info("announced", "tracker", tracker.Url, "event", "started", "peers", len(peers))
+		tm.events.publish(tm.Infohash, TrackerAnnounced{InfoHash: tm.Infohash, Tracker: tracker.Url, Event: "started", Peers: len(peers)})
 
 		newPeers := 0
 		for _, peer := range peers {
@@ -45,28 +96,96 @@ func (tm *TrackerManager) AskForPeers() {
 
 			tm.Pm.InsertPeer(peer)
 			newPeers++
-			go tm.connectToPeer(peer)
+			connections.Add(1)
+			go func() {
+				defer connections.Done()
+				tm.connectToPeer(ctx, peer)
+			}()
 		}
 
 		if newPeers > 0 {
-			totalPeers := len(tm.Pm.Peers)
-			fmt.Printf("  Added %d new peers (total: %d)\n", newPeers, totalPeers)
+			tm.log().Debug("added new peers", "new", newPeers, "total", tm.Pm.PeerCount())
 		}
 	}
 
-	totalPeers := len(tm.Pm.Peers)
-	fmt.Printf("\n Total unique peers: %d\n\n", totalPeers)
+	tm.log().Info("done asking trackers for peers", "peers", tm.Pm.PeerCount())
 }
 
-// connectToPeer establishes connection to a single peer
-func (tm *TrackerManager) connectToPeer(peer *Peer) {
-	err := peer.Handshake()
+// connectToPeer establishes connection to a single peer and listens to it
+// until it disconnects or ctx is done
+func (tm *TrackerManager) connectToPeer(ctx context.Context, peer *Peer) {
+	err := peer.Handshake(ctx)
 	if err != nil {
 		// Silently fail - don't spam console with failed connections
+		if peer.conn != nil {
+			peer.conn.Close()
+		}
+		return
+	}
+
+	peer.setStatus("connecting") // Will be set to "idle" after bitfield + unchoke
+	peer.log().Info("connected to peer")
+	tm.listen(ctx, peer, false)
+}
+
+// listen runs a connected peer's Listen, telling subscribers it came and
+// went
+func (tm *TrackerManager) listen(ctx context.Context, peer *Peer, incoming bool) {
+	tm.events.publish(tm.Infohash, PeerConnected{InfoHash: tm.Infohash, Addr: peer.Addr(), Incoming: incoming})
+	err := peer.Listen(ctx)
+	tm.events.publish(tm.Infohash, PeerDisconnected{InfoHash: tm.Infohash, Addr: peer.Addr(), Err: err})
+}
+
+// acceptPeer answers a peer that connected to us and already sent its
+// handshake, then listens to it until it disconnects or ctx is done
+func (tm *TrackerManager) acceptPeer(ctx context.Context, conn net.Conn, remotePeerID string) {
+	host, portStr, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	port, _ := strconv.Atoi(portStr)
+	infoHashBytes, _ := hex.DecodeString(tm.Infohash)
+
+	peer := &Peer{
+		id:          remotePeerID,
+		Ip:          host,
+		port:        uint(port),
+		infoHash:    string(infoHashBytes),
+		PeerId:      tm.announceRequest("", 0, 0).peerID,
+		TotalPieces: tm.TotalPieces,
+	}
+	err := peer.acceptHandshake(conn)
+	if err != nil {
+		tm.log().Debug("failed to answer peer", "peer", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
 		return
 	}
 
-	peer.Status = "connecting" // Will be set to "idle" after bitfield + unchoke
-	go peer.Listen()
-	fmt.Printf(" Connected to peer: %s\n", peer.Ip)
+	tm.Pm.InsertPeer(peer)
+	peer.setStatus("connecting")
+	peer.log().Info("peer connected to us")
+	tm.listen(ctx, peer, true)
+}
+
+// Announce tells every tracker (all at once) about an event (completed,
+// stopped) along with how much we have. Peers in the answers are ignored,
+// failures are only logged and published. Returns once every tracker
+// answered or timed out.
+func (tm *TrackerManager) Announce(ctx context.Context, event string, downloaded, left int64) {
+	var wg sync.WaitGroup
+	for _, tracker := range tm.Trackers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			peers, err := tracker.announce(ctx, tm.Infohash, tm.announceRequest(event, downloaded, left))
+			if err != nil {
+				// Not the tracker's fault when we gave up on it
+				if ctx.Err() == nil {
+					tm.log().Warn("announce failed", "tracker", tracker.Url, "event", event, "err", err)
+					tm.events.publish(tm.Infohash, TrackerError{InfoHash: tm.Infohash, Tracker: tracker.Url, Event: event, Err: err})
+				}
+				return
+			}
+			tm.log().Info("announced", "tracker", tracker.Url, "event", event)
+			tm.events.publish(tm.Infohash, TrackerAnnounced{InfoHash: tm.Infohash, Tracker: tracker.Url, Event: event, Peers: len(peers)})
+		}()
+	}
+	wg.Wait()
 }
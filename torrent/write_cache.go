@@ -0,0 +1,179 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Default memory budget for piece buffers
+const defaultCacheBudget = 64 * 1024 * 1024
+
+var errHashMismatch = errors.New("piece hash mismatch")
+
+// WriteCache is the memory budget piece buffers are allocated from. One
+// cache can be shared by every torrent so the budget is global. A zero
+// budget turns buffering off.
+type WriteCache struct {
+	Budget int64
+	used   int64
+	mu     sync.Mutex
+}
+
+func NewWriteCache(budget int64) *WriteCache {
+	return &WriteCache{Budget: budget}
+}
+
+func (cache *WriteCache) reserve(size int64) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.used+size > cache.Budget {
+		return false
+	}
+	cache.used += size
+	return true
+}
+
+func (cache *WriteCache) release(size int64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.used -= size
+}
+
+// pieceBuffer collects a piece's blocks in memory until it's complete
+type pieceBuffer struct {
+	data []byte
+	have []bool // by block index
+}
+
+// writeBlock buffers the block if its piece has a buffer or one fits in the
+// budget, otherwise writes it straight to storage. Blocks of one piece can
+// end up partly buffered and partly on disk (budget freed up mid piece,
+// blocks from a previous run), finishPiece deals with that.
+func (diskManager *DiskManager) writeBlock(pieceIndex int, blockIndex int, data []byte) error {
+	offset := int64(blockIndex) * blockLength
+
+	diskManager.buffersMu.Lock()
+	buffer, ok := diskManager.buffers[pieceIndex]
+	if !ok && diskManager.WriteCache != nil {
+		pieceLength := diskManager.pieceLength(pieceIndex)
+		if diskManager.WriteCache.reserve(pieceLength) {
+			buffer = &pieceBuffer{
+				data: make([]byte, pieceLength),
+				have: make([]bool, (pieceLength+blockLength-1)/blockLength),
+			}
+			diskManager.buffers[pieceIndex] = buffer
+		}
+	}
+
+	if buffer != nil {
+		if offset+int64(len(data)) > int64(len(buffer.data)) || blockIndex >= len(buffer.have) {
+			diskManager.buffersMu.Unlock()
+			return fmt.Errorf("block %d doesn't fit in piece %d", blockIndex, pieceIndex)
+		}
+		copy(buffer.data[offset:], data)
+		buffer.have[blockIndex] = true
+		diskManager.buffersMu.Unlock()
+		return nil
+	}
+	diskManager.buffersMu.Unlock()
+
+	// Under memory pressure, write directly
+	_, err := diskManager.writeAt(pieceIndex, data, offset)
+	return err
+}
+
+// FinishPiece is called once every block of a piece has been written. The
+// piece is hashed and, when it was buffered, written to storage in one go.
+// Returns errHashMismatch when the data is bad, the buffer is dropped then
+// and the piece has to be downloaded again.
+func (diskManager *DiskManager) FinishPiece(pieceIndex int) error {
+	diskManager.buffersMu.Lock()
+	buffer, ok := diskManager.buffers[pieceIndex]
+	delete(diskManager.buffers, pieceIndex)
+	diskManager.buffersMu.Unlock()
+
+	if !ok {
+		data, err := diskManager.ReadPiece(pieceIndex)
+		if err != nil {
+			return err
+		}
+		return diskManager.checkHash(pieceIndex, data)
+	}
+	defer diskManager.WriteCache.release(int64(len(buffer.data)))
+
+	// Blocks that didn't go through the buffer are already in storage
+	for blockIndex, have := range buffer.have {
+		if have {
+			continue
+		}
+		start := int64(blockIndex) * blockLength
+		end := min(start+blockLength, int64(len(buffer.data)))
+		_, err := diskManager.readAt(pieceIndex, buffer.data[start:end], start)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := diskManager.checkHash(pieceIndex, buffer.data)
+	if err != nil {
+		return err
+	}
+
+	_, err = diskManager.writeAt(pieceIndex, buffer.data, 0)
+	return err
+}
+
+func (diskManager *DiskManager) checkHash(pieceIndex int, data []byte) error {
+	hashes := diskManager.TorrentFileInfo.PieceHashes
+	// Nothing to check against (hand built TorrentFileInfo)
+	if len(hashes) == 0 {
+		return nil
+	}
+	if pieceIndex >= len(hashes) || sha1.Sum(data) != hashes[pieceIndex] {
+		return errHashMismatch
+	}
+	return nil
+}
+
+// Flush writes blocks of incomplete buffered pieces to storage and frees
+// the buffers, so nothing received is lost on shutdown
+func (diskManager *DiskManager) Flush() error {
+	diskManager.buffersMu.Lock()
+	defer diskManager.buffersMu.Unlock()
+
+	var firstErr error
+	for pieceIndex, buffer := range diskManager.buffers {
+		for blockIndex, have := range buffer.have {
+			if !have {
+				continue
+			}
+			start := int64(blockIndex) * blockLength
+			end := min(start+blockLength, int64(len(buffer.data)))
+			_, err := diskManager.writeAt(pieceIndex, buffer.data[start:end], start)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		diskManager.WriteCache.release(int64(len(buffer.data)))
+		delete(diskManager.buffers, pieceIndex)
+	}
+	return firstErr
+}
+
+// isBlockBuffered reports whether a block only exists in memory so far
+func (diskManager *DiskManager) isBlockBuffered(pieceIndex int, blockIndex uint) bool {
+	diskManager.buffersMu.Lock()
+	defer diskManager.buffersMu.Unlock()
+
+	buffer, ok := diskManager.buffers[pieceIndex]
+	return ok && int(blockIndex) < len(buffer.have) && buffer.have[blockIndex]
+}
+
+func (diskManager *DiskManager) pieceLength(pieceIndex int) int64 {
+	pieceStart := diskManager.TorrentFileInfo.PieceLength * int64(pieceIndex)
+	return min(diskManager.TorrentFileInfo.PieceLength, diskManager.TorrentFileInfo.FileLength-pieceStart)
+}